@@ -0,0 +1,141 @@
+package command
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// file extensions we'll read as text when Discord doesn't give a text content
+// type, which it often doesn't for code
+var textExtensions = map[string]bool{
+	".txt": true, ".md": true, ".log": true, ".csv": true, ".json": true, ".yaml": true, ".yml": true,
+	".toml": true, ".go": true, ".py": true, ".js": true, ".ts": true, ".sh": true, ".nix": true,
+}
+
+var attachmentClient = &http.Client{Timeout: 10 * time.Second}
+
+func isImage(a *discordgo.MessageAttachment) bool {
+	return strings.HasPrefix(a.ContentType, "image/")
+}
+
+func isText(a *discordgo.MessageAttachment) bool {
+	return strings.HasPrefix(a.ContentType, "text/") ||
+		strings.HasPrefix(a.ContentType, "application/json") ||
+		textExtensions[strings.ToLower(path.Ext(a.Filename))]
+}
+
+// supportsVision is whether the model can look at images
+func (c *Discord) supportsVision(model string) bool {
+	for _, prefix := range c.VisionModels {
+		if strings.HasPrefix(model, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// withAttachments adds the message's attachments and embeds to what's sent
+// to the model. text files are inlined up to the attachment limit, and
+// images become image parts, which are swapped out for a note at request
+// time if the model can't see them.
+func (c *Discord) withAttachments(message openai.ChatCompletionMessage, m *discordgo.Message) openai.ChatCompletionMessage {
+	text := []string{message.Content}
+	images := []string{}
+
+	for _, a := range m.Attachments {
+		switch {
+		case isImage(a):
+			images = append(images, a.URL)
+		case isText(a):
+			content, err := c.readAttachment(a)
+			if err != nil {
+				fmt.Printf("error reading attachment %s: %v\n", a.Filename, err)
+				text = append(text, fmt.Sprintf("[attached %s, which couldn't be read]", a.Filename))
+				continue
+			}
+			text = append(text, fmt.Sprintf("[attached %s]\n```\n%s\n```", a.Filename, content))
+		default:
+			text = append(text, fmt.Sprintf("[attached %s, which isn't text or an image]", a.Filename))
+		}
+	}
+	for _, e := range m.Embeds {
+		if e.Title != "" || e.Description != "" {
+			text = append(text, strings.TrimSpace(fmt.Sprintf("[embed] %s\n%s", e.Title, e.Description)))
+		}
+		if e.Image != nil && e.Image.URL != "" {
+			images = append(images, e.Image.URL)
+		} else if e.Thumbnail != nil && e.Thumbnail.URL != "" && e.Type == discordgo.EmbedTypeImage {
+			images = append(images, e.Thumbnail.URL)
+		}
+	}
+
+	message.Content = strings.Join(text, "\n\n")
+	if len(images) == 0 {
+		return message
+	}
+
+	// content and multi-part content can't both be set
+	message.MultiContent = []openai.ChatMessagePart{{Type: openai.ChatMessagePartTypeText, Text: message.Content}}
+	message.Content = ""
+	for _, url := range images {
+		message.MultiContent = append(message.MultiContent, openai.ChatMessagePart{
+			Type:     openai.ChatMessagePartTypeImageURL,
+			ImageURL: &openai.ChatMessageImageURL{URL: url, Detail: openai.ImageURLDetailAuto},
+		})
+	}
+	return message
+}
+
+// readAttachment downloads a text attachment, truncated to the attachment
+// limit
+func (c *Discord) readAttachment(a *discordgo.MessageAttachment) (string, error) {
+	resp, err := attachmentClient.Get(a.URL)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	b, err := io.ReadAll(io.LimitReader(resp.Body, int64(c.AttachmentLimit)+1))
+	if err != nil {
+		return "", err
+	}
+	if len(b) > c.AttachmentLimit {
+		return string(b[:c.AttachmentLimit]) + "\n[truncated]", nil
+	}
+	return string(b), nil
+}
+
+// forModel returns the messages as the model can take them, replacing images
+// with a note if it can't see them
+func (c *Discord) forModel(model string, messages []openai.ChatCompletionMessage) []openai.ChatCompletionMessage {
+	if c.supportsVision(model) {
+		return messages
+	}
+	converted := make([]openai.ChatCompletionMessage, len(messages))
+	for i, message := range messages {
+		if len(message.MultiContent) > 0 {
+			text := []string{}
+			for _, part := range message.MultiContent {
+				if part.Type == openai.ChatMessagePartTypeImageURL {
+					text = append(text, "[image omitted]")
+					continue
+				}
+				text = append(text, part.Text)
+			}
+			message.Content = strings.Join(text, "\n")
+			message.MultiContent = nil
+		}
+		converted[i] = message
+	}
+	return converted
+}
@@ -0,0 +1,16 @@
+package command
+
+import (
+	"context"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// backend is what the bot asks for completions and images. it's OpenAI's API
+// unless something else is plugged in, e.g. anything OpenAI compatible.
+type backend interface {
+	CreateChatCompletion(ctx context.Context, request openai.ChatCompletionRequest) (openai.ChatCompletionResponse, error)
+	CreateImage(ctx context.Context, request openai.ImageRequest) (openai.ImageResponse, error)
+}
+
+var _ backend = (*openai.Client)(nil)
@@ -3,6 +3,7 @@ package command
 import (
 	"fmt"
 	"math/rand"
+	"os"
 	"os/exec"
 	"time"
 
@@ -52,6 +53,16 @@ func (cmd *Command) Run() error {
 	return fmt.Errorf("command not implemented")
 }
 
+// writeFile writes to a temporary file first and renames it into place, so
+// that being killed mid-write doesn't leave a truncated file behind
+func writeFile(path string, b []byte) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
 func (ctx *Context) run(script string) (string, error) {
 	cmd := exec.Command("/bin/sh", "-c", script)
 	out, err := cmd.CombinedOutput()
@@ -0,0 +1,122 @@
+package command
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// how long a confirmation prompt waits for someone to answer it
+const confirmTimeout = time.Minute
+
+// the custom IDs of the confirmation prompt's buttons
+const (
+	confirmButtonID = "chatbot-confirm"
+	cancelButtonID  = "chatbot-cancel"
+)
+
+type confirmAnswer struct {
+	user      *discordgo.User
+	confirmed bool
+}
+
+// confirm asks whether to go ahead with something destructive, posting the
+// question with Confirm and Cancel buttons. it blocks until someone answers
+// or it times out, returning who confirmed, or an error saying why not.
+func (c *Discord) confirm(channelID, question string) (*discordgo.User, error) {
+	prompt, err := c.discord.ChannelMessageSendComplex(channelID, &discordgo.MessageSend{
+		Content: question,
+		Components: []discordgo.MessageComponent{
+			discordgo.ActionsRow{Components: []discordgo.MessageComponent{
+				discordgo.Button{Label: "Confirm", Style: discordgo.DangerButton, CustomID: confirmButtonID},
+				discordgo.Button{Label: "Cancel", Style: discordgo.SecondaryButton, CustomID: cancelButtonID},
+			}},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("asking for confirmation: %w", err)
+	}
+
+	answers := make(chan confirmAnswer, 1)
+	c.confirmMu.Lock()
+	if c.confirmations == nil {
+		c.confirmations = map[string]chan confirmAnswer{}
+	}
+	c.confirmations[prompt.ID] = answers
+	c.confirmMu.Unlock()
+	defer func() {
+		c.confirmMu.Lock()
+		delete(c.confirmations, prompt.ID)
+		c.confirmMu.Unlock()
+	}()
+
+	select {
+	case a := <-answers:
+		if !a.confirmed {
+			c.Kong.Printf("%s cancelled: %s", a.user.Username, question)
+			return nil, fmt.Errorf("cancelled by %s", a.user.Username)
+		}
+		c.Kong.Printf("%s confirmed: %s", a.user.Username, question)
+		return a.user, nil
+	case <-time.After(confirmTimeout):
+		c.closePrompt(prompt, "nobody answered in time")
+		c.Kong.Printf("nobody confirmed: %s", question)
+		return nil, fmt.Errorf("nobody confirmed within %s", confirmTimeout)
+	}
+}
+
+// closePrompt notes the outcome under a confirmation prompt and removes its
+// buttons
+func (c *Discord) closePrompt(prompt *discordgo.Message, outcome string) {
+	content := fmt.Sprintf("%s\n*%s*", prompt.Content, outcome)
+	_, err := c.discord.ChannelMessageEditComplex(&discordgo.MessageEdit{
+		ID:         prompt.ID,
+		Channel:    prompt.ChannelID,
+		Content:    &content,
+		Components: []discordgo.MessageComponent{},
+	})
+	if err != nil {
+		c.Kong.Printf("error closing confirmation prompt: %v", err)
+	}
+}
+
+func (c *Discord) onInteractionCreate(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	if i.Type != discordgo.InteractionMessageComponent || i.ChannelID != c.ManagementChannel {
+		return
+	}
+	id := i.MessageComponentData().CustomID
+	if id != confirmButtonID && id != cancelButtonID {
+		return
+	}
+	user := i.User
+	if i.Member != nil {
+		user = i.Member.User
+	}
+
+	// whoever answers first wins
+	c.confirmMu.Lock()
+	answers, ok := c.confirmations[i.Message.ID]
+	delete(c.confirmations, i.Message.ID)
+	c.confirmMu.Unlock()
+
+	outcome := "this expired"
+	if ok {
+		answers <- confirmAnswer{user: user, confirmed: id == confirmButtonID}
+		outcome = "cancelled by " + user.Mention()
+		if id == confirmButtonID {
+			outcome = "confirmed by " + user.Mention()
+		}
+	}
+	content := fmt.Sprintf("%s\n*%s*", i.Message.Content, outcome)
+	err := s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseUpdateMessage,
+		Data: &discordgo.InteractionResponseData{
+			Content:    content,
+			Components: []discordgo.MessageComponent{},
+		},
+	})
+	if err != nil {
+		c.Kong.Printf("error answering interaction: %v", err)
+	}
+}
@@ -1,8 +1,6 @@
 package command
 
 import (
-	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
@@ -12,6 +10,7 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
@@ -24,23 +23,50 @@ import (
 type Discord struct {
 	Command
 
-	DiscordToken      string `required:"" env:"DISCORD_TOKEN"`
-	ChatChannel       string `required:"" env:"CHAT_CHANNEL" help:"A channel ID to chat with the bot"`
-	ManagementChannel string `required:"" env:"MGMT_CHANNEL" name:"mgmt-channel" help:"A channel ID to listen for management commands in"`
+	DiscordToken      string            `required:"" env:"DISCORD_TOKEN"`
+	ChatChannel       string            `required:"" env:"CHAT_CHANNEL" help:"A channel ID to chat with the bot"`
+	ManagementChannel string            `required:"" env:"MGMT_CHANNEL" name:"mgmt-channel" help:"A channel ID to listen for management commands in"`
+	ChannelModes      map[string]string `optional:"" env:"CHANNEL_MODES" help:"Which messages to respond to per channel ID, one of always, mention, reply or never, e.g. 123=mention;456=never"`
+	channelModesMu    sync.Mutex
 	discord           *discordgo.Session
-
-	OpenAIAPIKey string   `name:"openai-api-key" required:"" env:"OPENAI_API_KEY"`
-	Model        string   `optional:"" name:"model" env:"MODEL"`
-	Temperature  float32  `optional:"" default:"1" env:"TEMPERATURE"`
-	TopP         float32  `optional:"" default:"1" env:"TOP_P"`
-	Prompts      *os.File `required:"" name:"prompts" env:"PROMPTS"`
-	prompts      *prompts
-	rawPrompts   []byte
-	personality  string   // the current prompt name
-	Users        *os.File `required:"" name:"users" env:"USERS"`
-	users        map[string]string
-	rawUsers     []byte
-	openai       *openai.Client
+	confirmations     map[string]chan confirmAnswer // keyed by prompt message ID
+	confirmMu         sync.Mutex
+
+	OpenAIAPIKey       string        `name:"openai-api-key" required:"" env:"OPENAI_API_KEY"`
+	Model              string        `optional:"" name:"model" env:"MODEL"`
+	Temperature        float32       `optional:"" default:"1" env:"TEMPERATURE"`
+	TopP               float32       `optional:"" default:"1" env:"TOP_P"`
+	VisionModels       []string      `optional:"" default:"gpt-4-vision,gpt-4-turbo,gpt-4o" env:"VISION_MODELS" help:"Prefixes of models that can see images, others get a note that an image was omitted"`
+	FallbackModels     []string      `optional:"" env:"FALLBACK_MODELS" help:"Models to try in order if the model fails"`
+	RequestTimeout     time.Duration `optional:"" default:"60s" env:"REQUEST_TIMEOUT" help:"How long to wait for a reply from a model, including retries"`
+	MaxRetries         int           `optional:"" default:"3" env:"MAX_RETRIES" help:"How many times to retry rate limited or failed requests, with backoff"`
+	MaxToolDepth       int           `optional:"" default:"3" env:"MAX_TOOL_DEPTH" help:"How many rounds of tool calls the model can make before it has to answer, 0 to disable tools"`
+	MinecraftStatusURL string        `optional:"" default:"https://api.mcsrvstat.us/bedrock/3/%s" env:"MINECRAFT_STATUS_URL" help:"A URL to check Minecraft servers' status with for the minecraft_status tool, %s is replaced with the server"`
+	AttachmentLimit    int           `optional:"" default:"8000" env:"ATTACHMENT_LIMIT" help:"The number of bytes of a text attachment to show the model"`
+	Prompts            *os.File      `required:"" name:"prompts" env:"PROMPTS"`
+	prompts            *prompts
+	rawPrompts         []byte
+	personality        string   // the current prompt name
+	Users              *os.File `required:"" name:"users" env:"USERS" help:"A YAML or JSON file of Discord user IDs to names, aliases, pronouns, blocked and personality"`
+	users              map[string]*user
+	usersJSON          bool // whether the users file is JSON
+	usersMu            sync.Mutex
+	openai             backend
+	ImageModel         string        `optional:"" default:"dall-e-3" env:"IMAGE_MODEL" help:"The model to generate images with for .imagine"`
+	ImageCost          float64       `optional:"" default:"0.04" env:"IMAGE_COST" help:"What an image costs, for tracking"`
+	ImageQuota         int           `optional:"" default:"5" env:"IMAGE_QUOTA" help:"The number of images a user can generate per day"`
+	ImageCooldown      time.Duration `optional:"" default:"1m" env:"IMAGE_COOLDOWN" help:"How long a user has to wait between images"`
+	ImageUsageFile     string        `optional:"" type:"path" env:"IMAGE_USAGE_FILE" help:"A path to a file to record generated images in"`
+	imageUsage         *imageUsage
+	imagining          map[string]bool // who's waiting on an image
+	imagineMu          sync.Mutex
+	KnowledgeDir       string                    `optional:"" type:"path" env:"KNOWLEDGE_DIR" help:"A directory of knowledge bases, a directory of markdown and text files per prompt name"`
+	KnowledgeTopK      int                       `optional:"" default:"3" env:"KNOWLEDGE_TOP_K" help:"How many relevant chunks of a knowledge base to add to each request"`
+	knowledge          map[string]*knowledgeBase // keyed by prompt name
+	knowledgeMu        sync.Mutex
+	MemoryFile         string `optional:"" type:"path" env:"MEMORY_FILE" help:"A path to a file to remember things about users in"`
+	MemoryLimit        int    `optional:"" default:"1000" env:"MEMORY_LIMIT" help:"The number of characters the bot can remember per user"`
+	memory             *memory
 
 	MessageContext             int          `optional:"" default:"20" env:"MESSAGE_CONTEXT" help:"The number of previous messages to send back to OpenAI"`
 	MessageContextInterval     int          `optional:"" default:"90" env:"MESSAGE_CONTEXT_INTERVAL" help:"The time in seconds until previous message context is reset, if no new messages are received"`
@@ -51,6 +77,10 @@ type Discord struct {
 	messageContextTicker       *time.Ticker // interval for resetting message context
 	messages                   *pkg.LimitedQueue[openai.ChatCompletionMessage]
 	replying                   bool
+	chatUsers                  map[string]bool // who's in the chat channel's current conversation
+	chatUsersMu                sync.Mutex
+	threads                    map[string]*thread // keyed by thread channel ID
+	threadsMu                  sync.Mutex
 }
 
 type prompts struct {
@@ -65,23 +95,14 @@ func (c *Discord) AfterApply() error {
 	if c.ChatChannel == c.ManagementChannel {
 		return errors.New("chat and management channels cannot be the same")
 	}
-
-	dg, err := discordgo.New("Bot " + c.DiscordToken)
-	if err != nil {
-		return fmt.Errorf("error creating Discord session: %w", err)
-	}
-	dg.AddHandler(c.onMessageCreate)
-	dg.Identify.Intents |= discordgo.IntentsAllWithoutPrivileged
-	dg.Identify.Intents |= discordgo.IntentsMessageContent
-	if err := dg.Open(); err != nil {
-		return fmt.Errorf("error opening connection: %w", err)
+	for id, mode := range c.ChannelModes {
+		if !validChannelMode(mode) {
+			return fmt.Errorf("invalid mode %q for channel %s, valid modes are: %s", mode, id, strings.Join(channelModes, ", "))
+		}
 	}
-	c.discord = dg
-	c.messageReplyTicker = time.NewTicker(1 * time.Second)
-	c.messageContextTicker = time.NewTicker(1 * time.Second)
 
 	if c.openai == nil {
-		c.openai = openai.NewClient(c.OpenAIAPIKey)
+		c.openai = c.newOpenAIClient()
 	}
 	if c.Model == "" {
 		c.Model = openai.GPT3Dot5Turbo
@@ -90,12 +111,42 @@ func (c *Discord) AfterApply() error {
 	if c.messages == nil {
 		c.messages = pkg.NewLimitedQueue[openai.ChatCompletionMessage](c.MessageContext)
 	}
+	if c.chatUsers == nil {
+		c.chatUsers = map[string]bool{}
+	}
 	if err := c.parsePrompts(); err != nil {
 		return err
 	}
 	if err := c.parseUsers(); err != nil {
 		return err
 	}
+	if err := c.loadKnowledge(); err != nil {
+		return err
+	}
+	var err error
+	if c.memory, err = loadMemory(c.MemoryFile, c.MemoryLimit); err != nil {
+		return err
+	}
+	if c.imageUsage, err = loadImageUsage(c.ImageUsageFile); err != nil {
+		return err
+	}
+
+	// only connect once everything's loaded, since messages can come in as
+	// soon as we do
+	dg, err := discordgo.New("Bot " + c.DiscordToken)
+	if err != nil {
+		return fmt.Errorf("error creating Discord session: %w", err)
+	}
+	dg.AddHandler(c.onMessageCreate)
+	dg.AddHandler(c.onInteractionCreate)
+	dg.Identify.Intents |= discordgo.IntentsAllWithoutPrivileged
+	dg.Identify.Intents |= discordgo.IntentsMessageContent
+	c.discord = dg
+	c.messageReplyTicker = time.NewTicker(1 * time.Second)
+	c.messageContextTicker = time.NewTicker(1 * time.Second)
+	if err := dg.Open(); err != nil {
+		return fmt.Errorf("error opening connection: %w", err)
+	}
 
 	return nil
 }
@@ -117,17 +168,6 @@ func (c *Discord) parsePrompts() error {
 	return nil
 }
 
-func (c *Discord) parseUsers() error {
-	var err error
-	if c.rawUsers, err = io.ReadAll(c.Users); err != nil {
-		return err
-	}
-	if err := json.Unmarshal(c.rawUsers, &c.users); err != nil {
-		return err
-	}
-	return nil
-}
-
 func (c *Discord) Run() error {
 	fmt.Println("Bot is now running. Press CTRL-C to exit.")
 
@@ -148,6 +188,8 @@ func (c *Discord) Run() error {
 	c.resetMessageTickers()
 	defer c.messageReplyTicker.Stop()
 	defer c.messageContextTicker.Stop()
+	threadTicker := time.NewTicker(time.Minute)
+	defer threadTicker.Stop()
 
 	for {
 		select {
@@ -161,6 +203,8 @@ func (c *Discord) Run() error {
 			}
 			// choose a random personality on reset
 			c.resetMessageQueue("")
+		case <-threadTicker.C:
+			c.archiveIdleThreads()
 		case <-sc:
 			return nil
 		}
@@ -180,12 +224,27 @@ func (c *Discord) resetMessageQueue(personality string) {
 	prompt := c.prompts.Personalities[c.personality]
 
 	c.messages = pkg.NewLimitedQueue[openai.ChatCompletionMessage](c.MessageContext)
+	c.chatUsersMu.Lock()
+	c.chatUsers = map[string]bool{}
+	c.chatUsersMu.Unlock()
 	c.messages.AddSticky(openai.ChatCompletionMessage{
 		Role:    openai.ChatMessageRoleSystem,
 		Content: prompt,
 	})
 }
 
+// currentChatUsers copies who's in the chat channel's conversation, since
+// messages keep coming in while we're replying
+func (c *Discord) currentChatUsers() map[string]bool {
+	c.chatUsersMu.Lock()
+	defer c.chatUsersMu.Unlock()
+	users := make(map[string]bool, len(c.chatUsers))
+	for id := range c.chatUsers {
+		users[id] = true
+	}
+	return users
+}
+
 func (c *Discord) resetMessageTickers() {
 	c.messageReplyTicker.Reset(time.Duration(c.MessageReplyInterval+rand.Intn(c.MessageReplyIntervalJitter)) * time.Second)
 	c.messageContextTicker.Reset(time.Duration(c.MessageContextInterval) * time.Second)
@@ -213,9 +272,15 @@ func (c *Discord) attemptSendReply(channel string) {
 	}
 
 	_ = c.discord.ChannelTyping(channel)
-	reply := c.makeChatRequestWithMessages(c.messages.AllItems())
+	reply := c.makeChatRequestWithMessages(channel, c.withKnowledge(c.personality, c.withMemories(c.messages.AllItems(), c.currentChatUsers())))
+	if reply == "" {
+		// don't keep retrying until someone says something else
+		c.messageReplyTicker.Stop()
+		c.replying = false
+		return
+	}
 
-	if _, err := c.discord.ChannelMessageSend(channel, reply); err != nil {
+	if err := c.sendReply(channel, reply, nil); err != nil {
 		fmt.Printf("error sending message: %v\n", err)
 	}
 }
@@ -234,18 +299,39 @@ func (c *Discord) handleManagementMessage(s *discordgo.Session, m *discordgo.Mes
 .info - show the internal settings of the bot
 .reset - reset the bot
 .users - show the known users
+.users add [id] [name] - add a user
+.users rm [id] - remove a user
+.users set [id] [key] [value] - set a user's name, aliases, pronouns, blocked or personality
 .prompt - show the available prompts
 .prompt add [name] [...] - add a new prompt (do not include the prefix or suffix)
 .prompt rm [name] - remove a prompt
 .set [key] [value] - set a key/value pair in the bot's settings
+.kb list [prompt] - list the files in the prompts' knowledge bases
+.kb add [prompt] [name] [text] - add text or an attached file to a prompt's knowledge base
+.kb rm [prompt] [name] - remove a file from a prompt's knowledge base
+.images - show this month's generated images and their cost
+.threads - show the active threads, started with .thread [prompt] outside this channel
+.channel [channel] [mode] - show or set which messages to respond to in a channel (always, mention, reply or never)
+
+anyone can use these outside this channel:
+.remember <fact> - have the bot remember something about you
+.forget [fact] - forget things about you containing the text, or everything
+.whoami - show what the bot knows about you
+.imagine <prompt> - generate an image, limited per user per day
 `
 	case m.Content == ".ping":
 		msg = "pong"
 	case m.Content == ".reset":
+		confirmer, err := c.confirm(m.ChannelID, "reset the conversation and pick a new prompt?")
+		if err != nil {
+			msg = fmt.Sprintf("not resetting: %v", err)
+			break
+		}
+		c.Kong.Printf("%s is resetting the conversation, confirmed by %s", m.Author.Username, confirmer.Username)
 		c.resetMessageQueue("")
 		c.resetMessageTickers()
-	case m.Content == ".users":
-		msg = string(c.rawUsers)
+	case m.Content == ".users" || strings.HasPrefix(m.Content, ".users "):
+		msg = c.handleUsersCommand(strings.TrimPrefix(m.Content, ".users"))
 	case m.Content == ".prompt":
 		b, _ := yaml.Marshal(c.prompts.Meta)
 		for name, prompt := range c.prompts.Personalities {
@@ -279,6 +365,12 @@ func (c *Discord) handleManagementMessage(s *discordgo.Session, m *discordgo.Mes
 			msg = fmt.Sprintf("prompt %s does not exist", val)
 			break
 		}
+		confirmer, err := c.confirm(m.ChannelID, fmt.Sprintf("remove prompt %s?", val))
+		if err != nil {
+			msg = fmt.Sprintf("not removing prompt %s: %v", val, err)
+			break
+		}
+		c.Kong.Printf("%s is removing prompt %s, confirmed by %s", m.Author.Username, val, confirmer.Username)
 		delete(c.prompts.Personalities, val)
 		msg = fmt.Sprintf("removed prompt %s", val)
 	case m.Content == ".info":
@@ -298,6 +390,14 @@ message_reply_interval: %ds
 message_reply_interval_jitter: %ds
 message_self_reply_chance: %d%%
 `, host, uptime, c.Model, c.personality, c.TopP, c.Temperature, len(c.messages.AllItems()), c.MessageContext, c.MessageContextInterval, c.MessageReplyInterval, c.MessageReplyIntervalJitter, c.MessageSelfReplyChance)
+	case m.Content == ".kb" || strings.HasPrefix(m.Content, ".kb "):
+		msg = c.handleKnowledgeCommand(m, strings.TrimPrefix(m.Content, ".kb"))
+	case m.Content == ".images":
+		msg = c.imageUsageReport()
+	case m.Content == ".threads":
+		msg = c.listThreads()
+	case m.Content == ".channel" || strings.HasPrefix(m.Content, ".channel "):
+		msg = c.setChannelMode(strings.TrimPrefix(m.Content, ".channel"))
 	case strings.HasPrefix(m.Content, ".set"):
 		content := strings.TrimSpace(strings.TrimPrefix(m.Content, ".set"))
 		parts := strings.SplitN(content, " ", 2)
@@ -402,13 +502,45 @@ func (c *Discord) setKeyVal(key, val string) string {
 }
 
 func (c *Discord) onMessageCreate(s *discordgo.Session, m *discordgo.MessageCreate) {
+	if m.ChannelID != c.ManagementChannel && c.blocked(m.Author.ID) {
+		return
+	}
+	// keep nicknames around for users who aren't in the users file
+	if m.Member != nil && m.GuildID != "" {
+		m.Member.User = m.Author
+		m.Member.GuildID = m.GuildID
+		_ = s.State.MemberAdd(m.Member)
+	}
+	if m.ChannelID != c.ManagementChannel && m.Author.ID != s.State.User.ID && c.handleMemoryCommand(s, m) {
+		return
+	}
+	if cmd, prompt, _ := strings.Cut(m.Content, " "); cmd == ".imagine" && m.ChannelID != c.ManagementChannel && m.Author.ID != s.State.User.ID {
+		c.imagine(s, m, strings.TrimSpace(prompt))
+		return
+	}
+	if t := c.thread(m.ChannelID); t != nil {
+		c.handleThreadMessage(s, m, t)
+		return
+	}
+	if cmd, _, _ := strings.Cut(m.Content, " "); cmd == ".thread" && m.ChannelID != c.ManagementChannel && m.Author.ID != s.State.User.ID {
+		if msg := c.startThread(s, m); msg != "" {
+			if _, err := s.ChannelMessageSendReply(m.ChannelID, msg, m.Reference()); err != nil {
+				fmt.Printf("error sending message: %v\n", err)
+			}
+		}
+		return
+	}
+
 	switch m.ChannelID {
 	case c.ManagementChannel:
 		c.handleManagementMessage(s, m)
 	case c.ChatChannel:
 		c.handleChatMessage(s, m)
 	default:
-		return
+		if m.Author.ID == s.State.User.ID || m.Author.Bot || !c.triggered(s, m) {
+			return
+		}
+		c.respondDirectly(s, m)
 	}
 }
 
@@ -417,59 +549,86 @@ func (c *Discord) handleChatMessage(s *discordgo.Session, m *discordgo.MessageCr
 		return
 	}
 
-	// replace <@id> in message with human name
-	for id, name := range c.users {
-		m.Content = strings.ReplaceAll(m.Content, "<@"+c.username(id)+">", name)
-	}
-
-	message := openai.ChatCompletionMessage{}
+	if m.Author.ID != s.State.User.ID {
+		if c.channelMode(m.ChannelID) == modeNever {
+			return
+		}
+		c.chatUsersMu.Lock()
+		c.chatUsers[m.Author.ID] = true
+		c.chatUsersMu.Unlock()
+
+		// if it's a reply to something that's fallen out of context, bring
+		// it back
+		if ref := referencedMessage(s, m); ref != nil {
+			refMessage := c.chatMessage(s, ref)
+			inContext := false
+			for _, item := range c.messages.Items() {
+				if item.Content == refMessage.Content {
+					inContext = true
+					break
+				}
+			}
+			if !inContext {
+				c.messages.Add(refMessage)
+			}
+		}
 
-	if m.Author.ID == s.State.User.ID {
-		// if it's a message from the model, don't prepend the username
-		message.Role = openai.ChatMessageRoleAssistant
-		message.Content = m.Content
-	} else {
-		// if a non-bot user sent a message, reset the ticker and start
-		// typing because the bot will reply on the next ticker interval
-		c.resetMessageTickers()
-		c.discord.ChannelTyping(m.ChannelID)
-		message.Role = openai.ChatMessageRoleUser
-		message.Content = fmt.Sprintf("%s: %s", c.username(m.Author.ID), m.Content)
+		// if a non-bot user sent a message the bot should respond to,
+		// reset the ticker and start typing because the bot will reply on
+		// the next ticker interval
+		if c.triggered(s, m) {
+			c.resetMessageTickers()
+			c.discord.ChannelTyping(m.ChannelID)
+		}
 	}
 
-	c.messages.Add(message)
+	// if it's a message from the model, the username isn't prepended
+	c.messages.Add(c.chatMessage(s, m.Message))
 }
 
-func (c *Discord) username(id string) string {
-	return strings.Title(strings.Split(c.users[id], "-")[0])
-}
+func (c *Discord) makeChatRequestWithMessages(channelID string, messages []openai.ChatCompletionMessage) string {
+	// copied, since tool calls and their results get appended
+	messages = append([]openai.ChatCompletionMessage{}, messages...)
+
+	var choices []openai.ChatCompletionChoice
+	for depth := 0; ; depth++ {
+		chatRequest := openai.ChatCompletionRequest{
+			Model:       c.Model,
+			Messages:    messages,
+			Temperature: c.Temperature,
+			TopP:        c.TopP,
+		}
+		// once it's called tools enough times, the model has to answer
+		if depth < c.MaxToolDepth {
+			chatRequest.Tools = toolDefinitions()
+		}
+		resp, err := c.createChatCompletion(chatRequest)
+		if err != nil {
+			// errors go to the management channel, not the chat, where
+			// they'd end up in the conversation
+			c.reportError("error replying in channel %s:\n%v", channelID, err)
+			return ""
+		}
 
-func (c *Discord) makeChatRequestWithMessages(messages []openai.ChatCompletionMessage) string {
-	chatRequest := openai.ChatCompletionRequest{
-		Model:       c.Model,
-		Messages:    messages,
-		Temperature: c.Temperature,
-		TopP:        c.TopP,
-	}
-	resp, err := c.openai.CreateChatCompletion(context.Background(), chatRequest)
-
-	e := &openai.APIError{}
-	if errors.As(err, &e) {
-		switch e.HTTPStatusCode {
-		case 401:
-			return fmt.Sprintf("invalid auth or key: %v\n", err)
-		case 429:
-			return fmt.Sprintf("rate limit exceeded: %v\n", err)
-		case 500:
-			return fmt.Sprintf("internal server error: %v\n", err)
-		default:
-			return fmt.Sprintf("unhandled error: %v\n", err)
+		choices = resp.Choices
+		if len(choices) < 1 {
+			return ""
+		}
+		if len(choices[0].Message.ToolCalls) == 0 {
+			break
+		}
+		// it was told it can't call any more, so don't keep paying for it
+		// to try
+		if depth >= c.MaxToolDepth {
+			c.Kong.Printf("ignoring tool calls past the max depth of %d in channel %s", c.MaxToolDepth, channelID)
+			break
 		}
-	}
 
-	choices := resp.Choices
-	if len(choices) < 1 {
-		return ""
+		// run what it asked for and let it carry on with the results
+		messages = append(messages, choices[0].Message)
+		for _, call := range choices[0].Message.ToolCalls {
+			messages = append(messages, c.runToolCall(channelID, call))
+		}
 	}
 
 	for _, choice := range choices {
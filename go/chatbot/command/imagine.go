@@ -0,0 +1,206 @@
+package command
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// imageUsage is every image generated, kept in a JSON file for cost tracking
+// and so that quotas survive restarts
+type imageUsage struct {
+	path   string
+	Images []*generatedImage `json:"images"`
+	mu     sync.Mutex
+}
+
+type generatedImage struct {
+	User    string    `json:"user"`
+	Prompt  string    `json:"prompt"`
+	Model   string    `json:"model"`
+	Cost    float64   `json:"cost"`
+	Created time.Time `json:"created"`
+}
+
+func loadImageUsage(path string) (*imageUsage, error) {
+	u := &imageUsage{path: path}
+	if path == "" {
+		return u, nil
+	}
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return u, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, u); err != nil {
+		return nil, fmt.Errorf("parsing image usage file: %w", err)
+	}
+	return u, nil
+}
+
+func (u *imageUsage) record(image *generatedImage) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.Images = append(u.Images, image)
+	if u.path == "" {
+		return nil
+	}
+	b, err := json.MarshalIndent(u, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFile(u.path, b)
+}
+
+// since returns the user's images since t, or everyone's if user is empty
+func (u *imageUsage) since(user string, t time.Time) []*generatedImage {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	images := []*generatedImage{}
+	for _, image := range u.Images {
+		if (user == "" || image.User == user) && !image.Created.Before(t) {
+			images = append(images, image)
+		}
+	}
+	return images
+}
+
+// checkImageQuota returns why the user can't generate an image right now, or
+// an empty string if they can
+func (c *Discord) checkImageQuota(user string) string {
+	now := time.Now()
+	recent := c.imageUsage.since(user, now.Add(-24*time.Hour))
+	if len(recent) >= c.ImageQuota {
+		oldest := recent[0].Created.Add(24 * time.Hour)
+		return fmt.Sprintf("you've used your %d images for the day, try again in %s", c.ImageQuota, oldest.Sub(now).Round(time.Minute))
+	}
+	if len(recent) > 0 {
+		if wait := recent[len(recent)-1].Created.Add(c.ImageCooldown).Sub(now); wait > 0 {
+			return fmt.Sprintf("slow down, try again in %s", wait.Round(time.Second))
+		}
+	}
+	return ""
+}
+
+// imagine handles .imagine <prompt>, generating an image and uploading it
+func (c *Discord) imagine(s *discordgo.Session, m *discordgo.MessageCreate, prompt string) {
+	reply := func(msg string) {
+		if _, err := s.ChannelMessageSendReply(m.ChannelID, msg, m.Reference()); err != nil {
+			fmt.Printf("error sending message: %v\n", err)
+		}
+	}
+	if prompt == "" {
+		reply("usage: .imagine <what to draw>")
+		return
+	}
+
+	// one at a time per user, so that someone can't get around their quota
+	// by asking for several at once
+	c.imagineMu.Lock()
+	if c.imagining[m.Author.ID] {
+		c.imagineMu.Unlock()
+		reply("hold on, I'm still drawing your last one")
+		return
+	}
+	if msg := c.checkImageQuota(m.Author.ID); msg != "" {
+		c.imagineMu.Unlock()
+		reply(msg)
+		return
+	}
+	if c.imagining == nil {
+		c.imagining = map[string]bool{}
+	}
+	c.imagining[m.Author.ID] = true
+	c.imagineMu.Unlock()
+	defer func() {
+		c.imagineMu.Lock()
+		delete(c.imagining, m.Author.ID)
+		c.imagineMu.Unlock()
+	}()
+
+	_ = s.ChannelTyping(m.ChannelID)
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+	resp, err := c.openai.CreateImage(ctx, openai.ImageRequest{
+		Prompt:         prompt,
+		Model:          c.ImageModel,
+		N:              1,
+		Size:           openai.CreateImageSize1024x1024,
+		ResponseFormat: openai.CreateImageResponseFormatB64JSON,
+		User:           m.Author.ID,
+	})
+	if err != nil {
+		c.reportError("error generating an image for %s:\n%s", m.Author.Username, describeError(err))
+		reply("couldn't draw that, try again later")
+		return
+	}
+	if len(resp.Data) == 0 {
+		reply("couldn't draw that, no image came back")
+		return
+	}
+	b, err := base64.StdEncoding.DecodeString(resp.Data[0].B64JSON)
+	if err != nil {
+		reply(fmt.Sprintf("couldn't decode the image: %v", err))
+		return
+	}
+
+	if err := c.imageUsage.record(&generatedImage{
+		User:    m.Author.ID,
+		Prompt:  prompt,
+		Model:   c.ImageModel,
+		Cost:    c.ImageCost,
+		Created: time.Now(),
+	}); err != nil {
+		c.Kong.Printf("error recording image usage: %v", err)
+	}
+	c.Kong.Printf("generated an image for %s: %s", m.Author.Username, prompt)
+
+	if _, err := s.ChannelFileSend(m.ChannelID, "imagine.png", bytes.NewReader(b)); err != nil {
+		fmt.Printf("error sending image: %v\n", err)
+	}
+}
+
+// imageUsageReport handles .images in the management channel, showing this
+// month's images and their cost per user
+func (c *Discord) imageUsageReport() string {
+	now := time.Now()
+	month := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, now.Location())
+	images := c.imageUsage.since("", month)
+	if len(images) == 0 {
+		return fmt.Sprintf("no images generated in %s", month.Format("January 2006"))
+	}
+
+	counts := map[string]int{}
+	costs := map[string]float64{}
+	total := 0.0
+	for _, image := range images {
+		counts[image.User]++
+		costs[image.User] += image.Cost
+		total += image.Cost
+	}
+	users := []string{}
+	for user := range counts {
+		users = append(users, user)
+	}
+	sort.Slice(users, func(i, j int) bool { return costs[users[i]] > costs[users[j]] })
+
+	lines := []string{fmt.Sprintf("images generated in %s:", month.Format("January 2006"))}
+	for _, user := range users {
+		lines = append(lines, fmt.Sprintf("%s: %d ($%.2f)", c.username(user), counts[user], costs[user]))
+	}
+	lines = append(lines, fmt.Sprintf("total: %d ($%.2f)", len(images), total))
+	return strings.Join(lines, "\n")
+}
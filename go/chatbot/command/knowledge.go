@@ -0,0 +1,365 @@
+package command
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/bwmarrin/discordgo"
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// a knowledge base is a directory of markdown and text files for a
+// personality, under the knowledge directory by the personality's name. the
+// files are split into chunks and the ones most relevant to the conversation
+// are added to the prompt, ranked with BM25.
+type knowledgeBase struct {
+	chunks []*chunk
+	df     map[string]int // how many chunks each term is in
+	avgLen float64
+}
+
+type chunk struct {
+	source string
+	text   string
+	terms  map[string]int
+	length int
+}
+
+const (
+	chunkSize          = 1000 // characters, give or take a paragraph
+	maxKnowledgeUpload = 1 << 20
+	bm25K1             = 1.2
+	bm25B              = 0.75
+)
+
+var stopWords = map[string]bool{
+	"the": true, "and": true, "for": true, "are": true, "but": true, "not": true, "you": true, "your": true,
+	"with": true, "this": true, "that": true, "have": true, "from": true, "was": true, "what": true,
+	"when": true, "where": true, "who": true, "how": true, "can": true, "its": true, "it's": true,
+	"about": true, "they": true, "them": true, "their": true, "there": true, "then": true, "than": true,
+	"just": true, "like": true, "will": true, "would": true, "should": true, "could": true, "been": true,
+}
+
+func tokenize(text string) []string {
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '\''
+	})
+	terms := []string{}
+	for _, w := range words {
+		w = strings.Trim(w, "'")
+		if len(w) < 2 || stopWords[w] {
+			continue
+		}
+		terms = append(terms, w)
+	}
+	return terms
+}
+
+func isKnowledgeFile(name string) bool {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".md", ".txt":
+		return true
+	}
+	return false
+}
+
+func loadKnowledgeBase(dir string) (*knowledgeBase, error) {
+	kb := &knowledgeBase{df: map[string]int{}}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() || !isKnowledgeFile(entry.Name()) {
+			continue
+		}
+		b, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		for _, text := range splitChunks(string(b)) {
+			kb.add(entry.Name(), text)
+		}
+	}
+
+	total := 0
+	for _, c := range kb.chunks {
+		total += c.length
+	}
+	if len(kb.chunks) > 0 {
+		kb.avgLen = float64(total) / float64(len(kb.chunks))
+	}
+	return kb, nil
+}
+
+// splitChunks splits text into chunks of whole paragraphs
+func splitChunks(text string) []string {
+	chunks := []string{}
+	current := ""
+	for _, paragraph := range strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n\n") {
+		paragraph = strings.TrimSpace(paragraph)
+		if paragraph == "" {
+			continue
+		}
+		if current != "" && len(current)+len(paragraph) > chunkSize {
+			chunks = append(chunks, current)
+			current = ""
+		}
+		if current != "" {
+			current += "\n\n"
+		}
+		current += paragraph
+	}
+	if current != "" {
+		chunks = append(chunks, current)
+	}
+	return chunks
+}
+
+func (kb *knowledgeBase) add(source, text string) {
+	terms := tokenize(text)
+	c := &chunk{source: source, text: text, terms: map[string]int{}, length: len(terms)}
+	for _, t := range terms {
+		if c.terms[t] == 0 {
+			kb.df[t]++
+		}
+		c.terms[t]++
+	}
+	kb.chunks = append(kb.chunks, c)
+}
+
+// search returns the k chunks most relevant to the query, best first
+func (kb *knowledgeBase) search(query string, k int) []*chunk {
+	terms := tokenize(query)
+	if len(terms) == 0 || len(kb.chunks) == 0 {
+		return nil
+	}
+
+	n := float64(len(kb.chunks))
+	scores := map[*chunk]float64{}
+	for _, c := range kb.chunks {
+		score := 0.0
+		for _, t := range terms {
+			tf := float64(c.terms[t])
+			if tf == 0 {
+				continue
+			}
+			df := float64(kb.df[t])
+			idf := math.Log(1 + (n-df+0.5)/(df+0.5))
+			score += idf * tf * (bm25K1 + 1) / (tf + bm25K1*(1-bm25B+bm25B*float64(c.length)/kb.avgLen))
+		}
+		if score > 0 {
+			scores[c] = score
+		}
+	}
+
+	ranked := []*chunk{}
+	for c := range scores {
+		ranked = append(ranked, c)
+	}
+	sort.Slice(ranked, func(i, j int) bool { return scores[ranked[i]] > scores[ranked[j]] })
+	if len(ranked) > k {
+		ranked = ranked[:k]
+	}
+	return ranked
+}
+
+// loadKnowledge indexes every personality's knowledge base
+func (c *Discord) loadKnowledge() error {
+	knowledge := map[string]*knowledgeBase{}
+	if c.KnowledgeDir != "" {
+		for personality := range c.prompts.Personalities {
+			dir := filepath.Join(c.KnowledgeDir, personality)
+			kb, err := loadKnowledgeBase(dir)
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			if err != nil {
+				return fmt.Errorf("loading knowledge for %s: %w", personality, err)
+			}
+			knowledge[personality] = kb
+		}
+	}
+
+	c.knowledgeMu.Lock()
+	c.knowledge = knowledge
+	c.knowledgeMu.Unlock()
+	return nil
+}
+
+// withKnowledge returns the messages with the chunks of the personality's
+// knowledge base most relevant to the latest message appended to the system
+// prompt
+func (c *Discord) withKnowledge(personality string, messages []openai.ChatCompletionMessage) []openai.ChatCompletionMessage {
+	c.knowledgeMu.Lock()
+	kb := c.knowledge[personality]
+	c.knowledgeMu.Unlock()
+	if kb == nil || len(messages) < 2 || messages[0].Role != openai.ChatMessageRoleSystem {
+		return messages
+	}
+
+	last := messages[len(messages)-1]
+	query := last.Content
+	for _, part := range last.MultiContent {
+		query += " " + part.Text
+	}
+	chunks := kb.search(query, c.KnowledgeTopK)
+	if len(chunks) == 0 {
+		return messages
+	}
+
+	notes := []string{}
+	for _, chunk := range chunks {
+		notes = append(notes, fmt.Sprintf("[%s]\n%s", chunk.source, chunk.text))
+	}
+	withKnowledge := append([]openai.ChatCompletionMessage{}, messages...)
+	withKnowledge[0].Content += "\n\nNotes that might be relevant, use them if they help:\n\n" + strings.Join(notes, "\n\n")
+	return withKnowledge
+}
+
+// handleKnowledgeCommand handles .kb list [personality], .kb add <personality>
+// <name> [text] with the text or an attached file, and .kb rm <personality>
+// <name>
+func (c *Discord) handleKnowledgeCommand(m *discordgo.MessageCreate, args string) string {
+	if c.KnowledgeDir == "" {
+		return "there's no knowledge directory, set --knowledge-dir"
+	}
+	fields := strings.Fields(args)
+	if len(fields) == 0 {
+		return "usage: .kb [list|add|rm] ..."
+	}
+
+	switch fields[0] {
+	case "list":
+		return c.listKnowledge(fields[1:])
+	case "add":
+		if len(fields) < 3 {
+			return "usage: .kb add <personality> <name> [text], or attach a file"
+		}
+		personality, name := fields[1], filepath.Base(fields[2])
+		if _, ok := c.prompts.Personalities[personality]; !ok {
+			return fmt.Sprintf("prompt %s does not exist", personality)
+		}
+		if !isKnowledgeFile(name) {
+			name += ".md"
+		}
+
+		var content string
+		if len(fields) > 3 {
+			// everything after the name, newlines and all
+			content = args
+			for _, f := range fields[:3] {
+				content = strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(content), f))
+			}
+		} else if len(m.Attachments) > 0 {
+			var err error
+			if content, err = downloadKnowledge(m.Attachments[0]); err != nil {
+				return fmt.Sprintf("error downloading %s: %v", m.Attachments[0].Filename, err)
+			}
+		} else {
+			return "please provide the text or attach a file"
+		}
+
+		dir := filepath.Join(c.KnowledgeDir, personality)
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return fmt.Sprintf("error creating %s: %v", dir, err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+			return fmt.Sprintf("error writing %s: %v", name, err)
+		}
+		if err := c.loadKnowledge(); err != nil {
+			return fmt.Sprintf("added %s, but reindexing failed: %v", name, err)
+		}
+		return fmt.Sprintf("added %s to %s's knowledge", name, personality)
+	case "rm":
+		if len(fields) != 3 {
+			return "usage: .kb rm <personality> <name>"
+		}
+		personality, name := fields[1], filepath.Base(fields[2])
+		if _, ok := c.prompts.Personalities[personality]; !ok {
+			return fmt.Sprintf("prompt %s does not exist", personality)
+		}
+		if !isKnowledgeFile(name) {
+			return "only markdown and text files are in knowledge bases"
+		}
+		path := filepath.Join(c.KnowledgeDir, personality, name)
+		if _, err := os.Stat(path); err != nil {
+			return fmt.Sprintf("%s isn't in %s's knowledge", name, personality)
+		}
+		confirmer, err := c.confirm(m.ChannelID, fmt.Sprintf("remove %s from %s's knowledge?", name, personality))
+		if err != nil {
+			return fmt.Sprintf("not removing %s: %v", name, err)
+		}
+		c.Kong.Printf("%s is removing %s from %s's knowledge, confirmed by %s", m.Author.Username, name, personality, confirmer.Username)
+		if err := os.Remove(path); err != nil {
+			return fmt.Sprintf("error removing %s: %v", name, err)
+		}
+		if err := c.loadKnowledge(); err != nil {
+			return fmt.Sprintf("removed %s, but reindexing failed: %v", name, err)
+		}
+		return fmt.Sprintf("removed %s from %s's knowledge", name, personality)
+	default:
+		return "usage: .kb [list|add|rm] ..."
+	}
+}
+
+func (c *Discord) listKnowledge(args []string) string {
+	c.knowledgeMu.Lock()
+	defer c.knowledgeMu.Unlock()
+
+	personalities := []string{}
+	for personality := range c.knowledge {
+		if len(args) == 0 || args[0] == personality {
+			personalities = append(personalities, personality)
+		}
+	}
+	if len(personalities) == 0 {
+		return "no knowledge bases yet, add to one with .kb add"
+	}
+	sort.Strings(personalities)
+
+	lines := []string{}
+	for _, personality := range personalities {
+		chunks := map[string]int{}
+		for _, chunk := range c.knowledge[personality].chunks {
+			chunks[chunk.source]++
+		}
+		sources := []string{}
+		for source := range chunks {
+			sources = append(sources, source)
+		}
+		sort.Strings(sources)
+		lines = append(lines, personality+":")
+		for _, source := range sources {
+			lines = append(lines, fmt.Sprintf("  %s (%d chunks)", source, chunks[source]))
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+func downloadKnowledge(a *discordgo.MessageAttachment) (string, error) {
+	if !isKnowledgeFile(a.Filename) {
+		return "", fmt.Errorf("only markdown and text files are supported")
+	}
+	if a.Size > maxKnowledgeUpload {
+		return "", fmt.Errorf("it's bigger than %d bytes", maxKnowledgeUpload)
+	}
+	resp, err := attachmentClient.Get(a.URL)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	b, err := io.ReadAll(io.LimitReader(resp.Body, maxKnowledgeUpload))
+	return string(b), err
+}
@@ -0,0 +1,170 @@
+package command
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/bwmarrin/discordgo"
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// memory is what the bot knows about each user, e.g. what to call them or
+// things they've asked it to remember. it's kept in a JSON file of user IDs
+// to facts, and fed to the model whenever that user is in the conversation.
+type memory struct {
+	path  string
+	limit int // characters of facts per user
+	facts map[string][]string
+	mu    sync.Mutex
+}
+
+func loadMemory(path string, limit int) (*memory, error) {
+	m := &memory{path: path, limit: limit, facts: map[string][]string{}}
+	if path == "" {
+		return m, nil
+	}
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return m, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &m.facts); err != nil {
+		return nil, fmt.Errorf("parsing memory file: %w", err)
+	}
+	return m, nil
+}
+
+// save writes the memory file, and is a no-op without one
+func (m *memory) save() error {
+	if m.path == "" {
+		return nil
+	}
+	b, err := json.MarshalIndent(m.facts, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFile(m.path, b)
+}
+
+func (m *memory) remember(id, fact string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	size := len(fact)
+	for _, f := range m.facts[id] {
+		size += len(f)
+	}
+	if size > m.limit {
+		return fmt.Errorf("that's more than the %d characters I can remember about you, .forget something first", m.limit)
+	}
+	m.facts[id] = append(m.facts[id], fact)
+	return m.save()
+}
+
+// forget drops the user's facts containing the text, or all of them if it's
+// empty, returning how many were forgotten
+func (m *memory) forget(id, text string) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	kept := []string{}
+	for _, f := range m.facts[id] {
+		if text != "" && !strings.Contains(strings.ToLower(f), strings.ToLower(text)) {
+			kept = append(kept, f)
+		}
+	}
+	forgotten := len(m.facts[id]) - len(kept)
+	if len(kept) == 0 {
+		delete(m.facts, id)
+	} else {
+		m.facts[id] = kept
+	}
+	return forgotten, m.save()
+}
+
+func (m *memory) recall(id string) []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]string{}, m.facts[id]...)
+}
+
+// withMemories returns the messages with what we know about the given users
+// appended to the system prompt
+func (c *Discord) withMemories(messages []openai.ChatCompletionMessage, users map[string]bool) []openai.ChatCompletionMessage {
+	ids := []string{}
+	for id := range users {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	lines := []string{}
+	for _, id := range ids {
+		about := c.memory.recall(id)
+		if u, ok := c.lookupUser(id); ok {
+			if u.Pronouns != "" {
+				about = append([]string{"pronouns " + u.Pronouns}, about...)
+			}
+			if len(u.Aliases) > 0 {
+				about = append([]string{"also goes by " + strings.Join(u.Aliases, ", ")}, about...)
+			}
+		}
+		if len(about) > 0 {
+			lines = append(lines, fmt.Sprintf("%s: %s", c.username(id), strings.Join(about, "; ")))
+		}
+	}
+	if len(lines) == 0 || len(messages) == 0 || messages[0].Role != openai.ChatMessageRoleSystem {
+		return messages
+	}
+
+	withMemories := append([]openai.ChatCompletionMessage{}, messages...)
+	withMemories[0].Content += "\n\nWhat you know about the people in this conversation:\n" + strings.Join(lines, "\n")
+	return withMemories
+}
+
+// handleMemoryCommand handles .remember, .forget and .whoami from anyone
+// outside the management channel, returning false if it isn't one of them
+func (c *Discord) handleMemoryCommand(s *discordgo.Session, m *discordgo.MessageCreate) bool {
+	cmd, args, _ := strings.Cut(m.Content, " ")
+	args = strings.TrimSpace(args)
+
+	var msg string
+	switch cmd {
+	case ".remember":
+		if args == "" {
+			msg = "usage: .remember <something about you>"
+			break
+		}
+		if err := c.memory.remember(m.Author.ID, args); err != nil {
+			msg = fmt.Sprintf("couldn't remember that: %v", err)
+			break
+		}
+		msg = "got it, I'll remember that"
+	case ".forget":
+		n, err := c.memory.forget(m.Author.ID, args)
+		if err != nil {
+			msg = fmt.Sprintf("couldn't forget that: %v", err)
+			break
+		}
+		msg = fmt.Sprintf("forgot %d things about you", n)
+	case ".whoami":
+		facts := c.memory.recall(m.Author.ID)
+		msg = fmt.Sprintf("you're %s", c.username(m.Author.ID))
+		if len(facts) > 0 {
+			msg += ", and I remember:\n- " + strings.Join(facts, "\n- ")
+		}
+	default:
+		return false
+	}
+
+	if _, err := s.ChannelMessageSendReply(m.ChannelID, msg, m.Reference()); err != nil {
+		fmt.Printf("error sending message: %v\n", err)
+	}
+	return true
+}
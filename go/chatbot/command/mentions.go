@@ -0,0 +1,140 @@
+package command
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// user, role and channel mentions, and custom emoji, e.g. <@123>, <@!123>,
+// <@&123>, <#123> and <:name:123>
+var mentionRegex = regexp.MustCompile(`<(@!?|@&|#|a?:(\w+):)(\d+)>`)
+
+// normalizeMentions renders the message's mentions as readable text for the
+// model, e.g. @Sam, @mods and #general. the bot's own mentions are dropped,
+// since it doesn't need to see itself being addressed.
+func (c *Discord) normalizeMentions(s *discordgo.Session, m *discordgo.Message) string {
+	content := mentionRegex.ReplaceAllStringFunc(m.Content, func(mention string) string {
+		match := mentionRegex.FindStringSubmatch(mention)
+		kind, emoji, id := match[1], match[2], match[3]
+		switch {
+		case kind == "@" || kind == "@!":
+			if id == s.State.User.ID {
+				return ""
+			}
+			if _, ok := c.lookupUser(id); !ok {
+				// Discord tells us who was mentioned, which saves a lookup
+				for _, u := range m.Mentions {
+					if u.ID == id {
+						if member, err := s.State.Member(m.GuildID, id); err == nil && member.Nick != "" {
+							return "@" + member.Nick
+						}
+						return "@" + u.Username
+					}
+				}
+			}
+			return "@" + c.username(id)
+		case kind == "@&":
+			if role, err := s.State.Role(m.GuildID, id); err == nil {
+				return "@" + role.Name
+			}
+			return "@role"
+		case kind == "#":
+			if ch, err := s.State.Channel(id); err == nil {
+				return "#" + ch.Name
+			}
+			return "#channel"
+		default:
+			return ":" + emoji + ":"
+		}
+	})
+	return strings.TrimSpace(content)
+}
+
+// mentionify turns @Name in the bot's reply back into a real mention when
+// Name is someone we know, by their name or alias in the users file, or
+// their nickname or username in the guild. bare names are left alone so that
+// talking about someone doesn't ping them.
+func (c *Discord) mentionify(guildID, reply string) string {
+	if !strings.Contains(reply, "@") {
+		return reply
+	}
+
+	names := map[string]string{} // lowercased name to ID
+	if guildID != "" {
+		if g, err := c.discord.State.Guild(guildID); err == nil {
+			for _, member := range g.Members {
+				if member.User == nil {
+					continue
+				}
+				names[strings.ToLower(member.User.Username)] = member.User.ID
+				if member.Nick != "" {
+					names[strings.ToLower(member.Nick)] = member.User.ID
+				}
+			}
+		}
+	}
+	// the users file wins over whatever's in the guild
+	for id, u := range c.knownUsers() {
+		names[strings.ToLower(u.Name)] = id
+		for _, alias := range u.Aliases {
+			names[strings.ToLower(alias)] = id
+		}
+	}
+
+	// longest first, so that @Sam Smith isn't taken for @Sam
+	sorted := make([]string, 0, len(names))
+	for name := range names {
+		if name != "" {
+			sorted = append(sorted, regexp.QuoteMeta(name))
+		}
+	}
+	if len(sorted) == 0 {
+		return reply
+	}
+	sort.Slice(sorted, func(i, j int) bool { return len(sorted[i]) > len(sorted[j]) })
+
+	// the @ can't follow a word character, so emails are left alone, and the
+	// name has to end at a non-word character rather than a word boundary,
+	// since names can end in punctuation
+	re := regexp.MustCompile(`(?i)(^|[^\w<@])@(` + strings.Join(sorted, "|") + `)($|[^\w@])`)
+	var b strings.Builder
+	for {
+		loc := re.FindStringSubmatchIndex(reply)
+		if loc == nil {
+			b.WriteString(reply)
+			break
+		}
+		// carry on from the end of the name, so that whatever's after it
+		// can come before the next mention
+		name := reply[loc[4]:loc[5]]
+		b.WriteString(reply[:loc[3]])
+		if id, ok := names[strings.ToLower(name)]; ok {
+			b.WriteString(fmt.Sprintf("<@%s>", id))
+		} else {
+			b.WriteString("@" + name)
+		}
+		reply = reply[loc[5]:]
+	}
+	return b.String()
+}
+
+// sendReply sends the bot's reply to the channel, as a Discord reply if ref
+// is set. only users can be pinged, so the model can't @everyone.
+func (c *Discord) sendReply(channelID, reply string, ref *discordgo.MessageReference) error {
+	guildID := ""
+	if ch, err := c.discord.State.Channel(channelID); err == nil {
+		guildID = ch.GuildID
+	}
+	_, err := c.discord.ChannelMessageSendComplex(channelID, &discordgo.MessageSend{
+		Content:   c.mentionify(guildID, reply),
+		Reference: ref,
+		AllowedMentions: &discordgo.MessageAllowedMentions{
+			Parse: []discordgo.AllowedMentionType{discordgo.AllowedMentionTypeUsers},
+		},
+	})
+	return err
+}
@@ -0,0 +1,32 @@
+package command
+
+import "testing"
+
+func TestMentionify(t *testing.T) {
+	c := &Discord{users: map[string]*user{
+		"1": {Name: "Sam"},
+		"2": {Name: "Sam Smith"},
+		"3": {Name: "bar"},
+		"4": {Name: "Jo!", Aliases: []string{"jojo"}},
+	}}
+	tests := []struct {
+		reply string
+		want  string
+	}{
+		{reply: "hi @Sam", want: "hi <@1>"},
+		{reply: "@sam, you there?", want: "<@1>, you there?"},
+		{reply: "hi @Sam Smith!", want: "hi <@2>!"},
+		{reply: "@Sammy isn't anyone", want: "@Sammy isn't anyone"},
+		{reply: "mail foo@bar.com", want: "mail foo@bar.com"},
+		{reply: "hey @Jo! and @JOJO", want: "hey <@4> and <@4>"},
+		{reply: "@Sam @bar @Jo!", want: "<@1> <@3> <@4>"},
+		{reply: "(@bar)", want: "(<@3>)"},
+		{reply: "<@1> already", want: "<@1> already"},
+		{reply: "no mentions for Sam", want: "no mentions for Sam"},
+	}
+	for _, tt := range tests {
+		if got := c.mentionify("", tt.reply); got != tt.want {
+			t.Errorf("mentionify(%q) = %q, want %q", tt.reply, got, tt.want)
+		}
+	}
+}
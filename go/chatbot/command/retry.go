@@ -0,0 +1,182 @@
+package command
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// how long to back off between retries, doubling from the min up to the max,
+// plus up to as much again in jitter
+const (
+	retryBackoffMin = 1 * time.Second
+	retryBackoffMax = 30 * time.Second
+)
+
+// retryTransport retries requests that were rate limited or hit a server
+// error, with exponential backoff and jitter, or as long as the Retry-After
+// header says. it sits under the OpenAI client since the client doesn't
+// expose response headers.
+type retryTransport struct {
+	base       http.RoundTripper
+	maxRetries int
+	logf       func(format string, args ...any)
+}
+
+// retryable is whether the request can safely be tried again. chat and image
+// requests aren't idempotent, so other transport errors aren't retried, since
+// the first attempt might have gone through and been billed.
+func retryable(resp *http.Response, err error) bool {
+	if err != nil {
+		// it never reached the server
+		e := &net.OpError{}
+		return errors.As(err, &e) && e.Op == "dial"
+	}
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// retryAfter is how long the response asks us to wait, or 0 if it doesn't
+func retryAfter(resp *http.Response) time.Duration {
+	if resp == nil {
+		return 0
+	}
+	h := resp.Header.Get("Retry-After")
+	if secs, err := strconv.Atoi(h); err == nil {
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(h); err == nil {
+		return time.Until(t)
+	}
+	return 0
+}
+
+func backoff(attempt int) time.Duration {
+	d := retryBackoffMin << attempt
+	if d > retryBackoffMax || d <= 0 {
+		d = retryBackoffMax
+	}
+	return d + time.Duration(rand.Int63n(int64(d)))
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	attemptReq := req
+	for attempt := 0; ; attempt++ {
+		resp, err := t.base.RoundTrip(attemptReq)
+		// without GetBody the body's been used up, so it can't be sent again
+		if attempt >= t.maxRetries || !retryable(resp, err) || (req.Body != nil && req.GetBody == nil) {
+			return resp, err
+		}
+
+		wait := retryAfter(resp)
+		if wait <= 0 {
+			wait = backoff(attempt)
+		}
+		status := fmt.Sprint(err)
+		if resp != nil {
+			status = resp.Status
+			_, _ = io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		t.logf("%s %s: %s, retrying in %s", req.Method, req.URL.Path, status, wait.Round(time.Millisecond))
+
+		select {
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		case <-time.After(wait):
+		}
+
+		// a round tripper mustn't modify the caller's request, so each
+		// retry gets its own copy with a fresh body
+		attemptReq = req.Clone(req.Context())
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			attemptReq.Body = body
+		}
+	}
+}
+
+func (c *Discord) newOpenAIClient() *openai.Client {
+	config := openai.DefaultConfig(c.OpenAIAPIKey)
+	config.HTTPClient = &http.Client{Transport: &retryTransport{
+		base:       http.DefaultTransport,
+		maxRetries: c.MaxRetries,
+		logf:       func(format string, args ...any) { c.Kong.Printf(format, args...) },
+	}}
+	return openai.NewClientWithConfig(config)
+}
+
+// createChatCompletion makes the request with the model, falling back to the
+// fallback models in order if it fails. each try gets its own timeout.
+func (c *Discord) createChatCompletion(request openai.ChatCompletionRequest) (openai.ChatCompletionResponse, error) {
+	models := append([]string{c.Model}, c.FallbackModels...)
+	messages := request.Messages
+	errs := []error{}
+	for _, model := range models {
+		request.Model = model
+		request.Messages = c.forModel(model, messages)
+
+		ctx, cancel := context.WithTimeout(context.Background(), c.RequestTimeout)
+		resp, err := c.openai.CreateChatCompletion(ctx, request)
+		cancel()
+		if err == nil {
+			return resp, nil
+		}
+		errs = append(errs, fmt.Errorf("%s: %s", model, describeError(err)))
+
+		// another model won't fix a bad key
+		e := &openai.APIError{}
+		if errors.As(err, &e) && e.HTTPStatusCode == http.StatusUnauthorized {
+			break
+		}
+	}
+	return openai.ChatCompletionResponse{}, errors.Join(errs...)
+}
+
+func describeError(err error) string {
+	e := &openai.APIError{}
+	if errors.As(err, &e) {
+		switch e.HTTPStatusCode {
+		case 401:
+			return fmt.Sprintf("invalid auth or key: %v", err)
+		case 429:
+			return fmt.Sprintf("rate limit exceeded: %v", err)
+		case 500:
+			return fmt.Sprintf("internal server error: %v", err)
+		default:
+			return fmt.Sprintf("unhandled error: %v", err)
+		}
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return "timed out"
+	}
+	return err.Error()
+}
+
+// reportError lets the management channel know something went wrong, rather
+// than whoever's chatting
+func (c *Discord) reportError(format string, args ...any) {
+	msg := fmt.Sprintf(format, args...)
+	c.Kong.Printf("%s", msg)
+	if len(msg) > 1900 {
+		msg = msg[:1900] + "..."
+	}
+	if _, err := c.discord.ChannelMessageSend(c.ManagementChannel, "```"+strings.TrimSpace(msg)+"```"); err != nil {
+		c.Kong.Printf("error sending message: %v", err)
+	}
+}
@@ -0,0 +1,140 @@
+package command
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/andreykaipov/discord-bots/go/chatbot/pkg"
+	"github.com/bwmarrin/discordgo"
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// a thread is a conversation in its own Discord thread, with its own prompt
+// and history, so that it doesn't bleed into the chat channel's
+type thread struct {
+	personality string
+	messages    *pkg.LimitedQueue[openai.ChatCompletionMessage]
+	lastActive  time.Time
+	users       map[string]bool // who's talked in it
+	mu          sync.Mutex      // one reply at a time
+}
+
+// how long Discord waits before archiving a thread on its own, in minutes.
+// we usually archive them much sooner.
+const threadAutoArchive = 60
+
+// startThread handles .thread [prompt], starting a thread off the message
+func (c *Discord) startThread(s *discordgo.Session, m *discordgo.MessageCreate) string {
+	personality := strings.TrimSpace(strings.TrimPrefix(m.Content, ".thread"))
+	if personality == "" {
+		personality = c.personalityFor(m.Author.ID)
+	}
+	prompt, ok := c.prompts.Personalities[personality]
+	if !ok {
+		return fmt.Sprintf("prompt %s does not exist", personality)
+	}
+
+	ch, err := s.MessageThreadStart(m.ChannelID, m.ID, fmt.Sprintf("chat with %s", personality), threadAutoArchive)
+	if err != nil {
+		return fmt.Sprintf("error starting thread: %v", err)
+	}
+
+	t := &thread{
+		personality: personality,
+		messages:    pkg.NewLimitedQueue[openai.ChatCompletionMessage](c.MessageContext),
+		lastActive:  time.Now(),
+		users:       map[string]bool{m.Author.ID: true},
+	}
+	t.messages.AddSticky(openai.ChatCompletionMessage{
+		Role:    openai.ChatMessageRoleSystem,
+		Content: prompt,
+	})
+
+	c.threadsMu.Lock()
+	if c.threads == nil {
+		c.threads = map[string]*thread{}
+	}
+	c.threads[ch.ID] = t
+	c.threadsMu.Unlock()
+
+	c.Kong.Printf("started thread %s with prompt %s", ch.ID, personality)
+	return ""
+}
+
+func (c *Discord) thread(channelID string) *thread {
+	c.threadsMu.Lock()
+	defer c.threadsMu.Unlock()
+	return c.threads[channelID]
+}
+
+// handleThreadMessage replies to every message in a thread right away, since
+// whoever's in it is there to talk to the bot
+func (c *Discord) handleThreadMessage(s *discordgo.Session, m *discordgo.MessageCreate, t *thread) {
+	if m.Author.ID == s.State.User.ID || strings.HasPrefix(m.Content, "//") {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.lastActive = time.Now()
+	t.users[m.Author.ID] = true
+	t.messages.Add(c.chatMessage(s, m.Message))
+
+	_ = s.ChannelTyping(m.ChannelID)
+	reply := c.makeChatRequestWithMessages(m.ChannelID, c.withKnowledge(t.personality, c.withMemories(t.messages.AllItems(), t.users)))
+	if reply == "" {
+		return
+	}
+	t.messages.Add(openai.ChatCompletionMessage{Role: openai.ChatMessageRoleAssistant, Content: reply})
+	if err := c.sendReply(m.ChannelID, reply, nil); err != nil {
+		fmt.Printf("error sending message: %v\n", err)
+	}
+}
+
+// archiveIdleThreads archives threads that haven't had a message within the
+// message context interval, forgetting their history
+func (c *Discord) archiveIdleThreads() {
+	idle := time.Duration(c.MessageContextInterval) * time.Second
+
+	c.threadsMu.Lock()
+	expired := []string{}
+	for id, t := range c.threads {
+		// it's busy replying, so it's hardly idle
+		if !t.mu.TryLock() {
+			continue
+		}
+		if time.Since(t.lastActive) >= idle {
+			expired = append(expired, id)
+			delete(c.threads, id)
+		}
+		t.mu.Unlock()
+	}
+	c.threadsMu.Unlock()
+
+	archived := true
+	for _, id := range expired {
+		if _, err := c.discord.ChannelEdit(id, &discordgo.ChannelEdit{Archived: &archived}); err != nil {
+			c.Kong.Printf("error archiving thread %s: %v", id, err)
+			continue
+		}
+		c.Kong.Printf("archived idle thread %s", id)
+	}
+}
+
+func (c *Discord) listThreads() string {
+	c.threadsMu.Lock()
+	defer c.threadsMu.Unlock()
+	if len(c.threads) == 0 {
+		return "no active threads, start one with .thread [prompt] in a chat channel"
+	}
+	lines := []string{}
+	for id, t := range c.threads {
+		lines = append(lines, fmt.Sprintf("%s: %s, %d messages", id, t.personality, len(t.messages.Items())))
+	}
+	sort.Strings(lines)
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,347 @@
+package command
+
+import (
+	"encoding/json"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io"
+	"math"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// a tool is a Go function the model can ask us to call, e.g. to roll dice
+// instead of pretending to. its parameters are a JSON schema, and whatever it
+// returns, or its error, goes back to the model.
+type tool struct {
+	description string
+	parameters  string
+	run         func(c *Discord, channelID string, args json.RawMessage) (string, error)
+}
+
+var tools = map[string]*tool{
+	"current_time": {
+		description: "Get the current date and time",
+		parameters: `{"type": "object", "properties": {
+			"timezone": {"type": "string", "description": "An IANA timezone, e.g. America/New_York, defaults to UTC"}
+		}}`,
+		run: currentTime,
+	},
+	"roll_dice": {
+		description: "Roll dice in standard notation, e.g. 2d6+3",
+		parameters: `{"type": "object", "required": ["dice"], "properties": {
+			"dice": {"type": "string", "description": "The dice to roll, e.g. d20, 2d6 or 3d8-1"}
+		}}`,
+		run: rollDice,
+	},
+	"create_poll": {
+		description: "Post a poll in the channel that people vote on with reactions",
+		parameters: `{"type": "object", "required": ["question", "options"], "properties": {
+			"question": {"type": "string"},
+			"options": {"type": "array", "items": {"type": "string"}, "minItems": 2, "maxItems": 10}
+		}}`,
+		run: createPoll,
+	},
+	"minecraft_status": {
+		description: "Check whether a Minecraft server is online and who's playing",
+		parameters: `{"type": "object", "required": ["server"], "properties": {
+			"server": {"type": "string", "description": "The server's address, e.g. mc.example.com"}
+		}}`,
+		run: minecraftStatus,
+	},
+	"calculate": {
+		description: "Evaluate an arithmetic expression, e.g. (3 + 4) * sqrt(2). supports + - * / %, parentheses, and sqrt, pow, abs, floor, ceil, round, min, max, log, sin and cos",
+		parameters: `{"type": "object", "required": ["expression"], "properties": {
+			"expression": {"type": "string"}
+		}}`,
+		run: calculate,
+	},
+}
+
+func toolDefinitions() []openai.Tool {
+	names := []string{}
+	for name := range tools {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	definitions := []openai.Tool{}
+	for _, name := range names {
+		definitions = append(definitions, openai.Tool{
+			Type: openai.ToolTypeFunction,
+			Function: openai.FunctionDefinition{
+				Name:        name,
+				Description: tools[name].description,
+				Parameters:  json.RawMessage(tools[name].parameters),
+			},
+		})
+	}
+	return definitions
+}
+
+// runToolCall runs a tool the model asked for, returning the message with
+// its result to send back
+func (c *Discord) runToolCall(channelID string, call openai.ToolCall) openai.ChatCompletionMessage {
+	result := ""
+	t, ok := tools[call.Function.Name]
+	if !ok {
+		result = fmt.Sprintf("error: there's no tool called %s", call.Function.Name)
+	} else {
+		out, err := t.run(c, channelID, json.RawMessage(call.Function.Arguments))
+		if err != nil {
+			result = fmt.Sprintf("error: %v", err)
+		} else {
+			result = out
+		}
+	}
+	c.Kong.Printf("tool %s(%s): %s", call.Function.Name, call.Function.Arguments, result)
+	return openai.ChatCompletionMessage{
+		Role:       openai.ChatMessageRoleTool,
+		Content:    result,
+		ToolCallID: call.ID,
+	}
+}
+
+func currentTime(c *Discord, channelID string, args json.RawMessage) (string, error) {
+	var params struct {
+		Timezone string `json:"timezone"`
+	}
+	if err := json.Unmarshal(args, &params); err != nil {
+		return "", err
+	}
+	loc := time.UTC
+	if params.Timezone != "" {
+		var err error
+		if loc, err = time.LoadLocation(params.Timezone); err != nil {
+			return "", err
+		}
+	}
+	return time.Now().In(loc).Format("Monday, January 2, 2006 15:04:05 MST"), nil
+}
+
+var diceRegex = regexp.MustCompile(`^(\d*)d(\d+)([+-]\d+)?$`)
+
+func rollDice(c *Discord, channelID string, args json.RawMessage) (string, error) {
+	var params struct {
+		Dice string `json:"dice"`
+	}
+	if err := json.Unmarshal(args, &params); err != nil {
+		return "", err
+	}
+	match := diceRegex.FindStringSubmatch(strings.ToLower(strings.ReplaceAll(params.Dice, " ", "")))
+	if match == nil {
+		return "", fmt.Errorf("%q isn't dice notation like 2d6+3", params.Dice)
+	}
+	count := 1
+	if match[1] != "" {
+		count, _ = strconv.Atoi(match[1])
+	}
+	sides, _ := strconv.Atoi(match[2])
+	modifier, _ := strconv.Atoi(match[3])
+	if count < 1 || count > 100 || sides < 2 || sides > 1000 {
+		return "", fmt.Errorf("can roll 1 to 100 dice with 2 to 1000 sides")
+	}
+
+	rolls := []string{}
+	total := modifier
+	for i := 0; i < count; i++ {
+		roll := rand.Intn(sides) + 1
+		total += roll
+		rolls = append(rolls, strconv.Itoa(roll))
+	}
+	return fmt.Sprintf("rolled %s: %s, total %d", params.Dice, strings.Join(rolls, ", "), total), nil
+}
+
+var pollEmoji = []string{"1️⃣", "2️⃣", "3️⃣", "4️⃣", "5️⃣", "6️⃣", "7️⃣", "8️⃣", "9️⃣", "🔟"}
+
+func createPoll(c *Discord, channelID string, args json.RawMessage) (string, error) {
+	var params struct {
+		Question string   `json:"question"`
+		Options  []string `json:"options"`
+	}
+	if err := json.Unmarshal(args, &params); err != nil {
+		return "", err
+	}
+	if len(params.Options) < 2 || len(params.Options) > len(pollEmoji) {
+		return "", fmt.Errorf("a poll needs 2 to %d options", len(pollEmoji))
+	}
+
+	lines := []string{"📊 **" + params.Question + "**"}
+	for i, option := range params.Options {
+		lines = append(lines, fmt.Sprintf("%s %s", pollEmoji[i], option))
+	}
+	m, err := c.discord.ChannelMessageSend(channelID, strings.Join(lines, "\n"))
+	if err != nil {
+		return "", err
+	}
+	for i := range params.Options {
+		if err := c.discord.MessageReactionAdd(channelID, m.ID, pollEmoji[i]); err != nil {
+			return "", err
+		}
+	}
+	return "posted the poll, no need to repeat it", nil
+}
+
+var statusClient = &http.Client{Timeout: 10 * time.Second}
+
+func minecraftStatus(c *Discord, channelID string, args json.RawMessage) (string, error) {
+	var params struct {
+		Server string `json:"server"`
+	}
+	if err := json.Unmarshal(args, &params); err != nil {
+		return "", err
+	}
+	if params.Server == "" {
+		return "", fmt.Errorf("no server given")
+	}
+	resp, err := statusClient.Get(fmt.Sprintf(c.MinecraftStatusURL, url.PathEscape(params.Server)))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("status source returned %s", resp.Status)
+	}
+	b, err := io.ReadAll(io.LimitReader(resp.Body, 4000))
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+func calculate(c *Discord, channelID string, args json.RawMessage) (string, error) {
+	var params struct {
+		Expression string `json:"expression"`
+	}
+	if err := json.Unmarshal(args, &params); err != nil {
+		return "", err
+	}
+	expr, err := parser.ParseExpr(params.Expression)
+	if err != nil {
+		return "", fmt.Errorf("invalid expression: %w", err)
+	}
+	result, err := evaluate(expr)
+	if err != nil {
+		return "", err
+	}
+	return strconv.FormatFloat(result, 'g', -1, 64), nil
+}
+
+var mathFuncs = map[string]func(args ...float64) (float64, error){
+	"sqrt":  unary(math.Sqrt),
+	"abs":   unary(math.Abs),
+	"floor": unary(math.Floor),
+	"ceil":  unary(math.Ceil),
+	"round": unary(math.Round),
+	"log":   unary(math.Log),
+	"sin":   unary(math.Sin),
+	"cos":   unary(math.Cos),
+	"pow":   binary(math.Pow),
+	"min":   binary(math.Min),
+	"max":   binary(math.Max),
+}
+
+func unary(f func(float64) float64) func(...float64) (float64, error) {
+	return func(args ...float64) (float64, error) {
+		if len(args) != 1 {
+			return 0, fmt.Errorf("expected 1 argument, got %d", len(args))
+		}
+		return f(args[0]), nil
+	}
+}
+
+func binary(f func(float64, float64) float64) func(...float64) (float64, error) {
+	return func(args ...float64) (float64, error) {
+		if len(args) != 2 {
+			return 0, fmt.Errorf("expected 2 arguments, got %d", len(args))
+		}
+		return f(args[0], args[1]), nil
+	}
+}
+
+// evaluate walks an arithmetic expression parsed as Go
+func evaluate(expr ast.Expr) (float64, error) {
+	switch e := expr.(type) {
+	case *ast.BasicLit:
+		if e.Kind != token.INT && e.Kind != token.FLOAT {
+			return 0, fmt.Errorf("unexpected %s", e.Value)
+		}
+		return strconv.ParseFloat(e.Value, 64)
+	case *ast.Ident:
+		switch e.Name {
+		case "pi":
+			return math.Pi, nil
+		case "e":
+			return math.E, nil
+		}
+		return 0, fmt.Errorf("unknown name %s", e.Name)
+	case *ast.ParenExpr:
+		return evaluate(e.X)
+	case *ast.UnaryExpr:
+		x, err := evaluate(e.X)
+		if err != nil {
+			return 0, err
+		}
+		switch e.Op {
+		case token.SUB:
+			return -x, nil
+		case token.ADD:
+			return x, nil
+		}
+		return 0, fmt.Errorf("unsupported operator %s", e.Op)
+	case *ast.BinaryExpr:
+		x, err := evaluate(e.X)
+		if err != nil {
+			return 0, err
+		}
+		y, err := evaluate(e.Y)
+		if err != nil {
+			return 0, err
+		}
+		switch e.Op {
+		case token.ADD:
+			return x + y, nil
+		case token.SUB:
+			return x - y, nil
+		case token.MUL:
+			return x * y, nil
+		case token.QUO:
+			if y == 0 {
+				return 0, fmt.Errorf("division by zero")
+			}
+			return x / y, nil
+		case token.REM:
+			return math.Mod(x, y), nil
+		}
+		return 0, fmt.Errorf("unsupported operator %s", e.Op)
+	case *ast.CallExpr:
+		name, ok := e.Fun.(*ast.Ident)
+		if !ok {
+			return 0, fmt.Errorf("unsupported function call")
+		}
+		f, ok := mathFuncs[name.Name]
+		if !ok {
+			return 0, fmt.Errorf("unknown function %s", name.Name)
+		}
+		args := []float64{}
+		for _, arg := range e.Args {
+			x, err := evaluate(arg)
+			if err != nil {
+				return 0, err
+			}
+			args = append(args, x)
+		}
+		return f(args...)
+	}
+	return 0, fmt.Errorf("unsupported expression")
+}
@@ -0,0 +1,311 @@
+package command
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alecthomas/kong"
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// fakeBackend answers chat completions from a script, one response per
+// request, and remembers the requests it got
+type fakeBackend struct {
+	responses []openai.ChatCompletionMessage
+	requests  []openai.ChatCompletionRequest
+}
+
+func (f *fakeBackend) CreateChatCompletion(ctx context.Context, request openai.ChatCompletionRequest) (openai.ChatCompletionResponse, error) {
+	f.requests = append(f.requests, request)
+	if len(f.requests) > len(f.responses) {
+		return openai.ChatCompletionResponse{}, fmt.Errorf("unexpected request %d", len(f.requests))
+	}
+	return openai.ChatCompletionResponse{
+		Choices: []openai.ChatCompletionChoice{{Message: f.responses[len(f.requests)-1]}},
+	}, nil
+}
+
+func (f *fakeBackend) CreateImage(ctx context.Context, request openai.ImageRequest) (openai.ImageResponse, error) {
+	return openai.ImageResponse{}, fmt.Errorf("not implemented")
+}
+
+func newTestDiscord(t *testing.T, b backend) *Discord {
+	t.Helper()
+	k, err := kong.New(&struct{}{}, kong.Writers(io.Discard, io.Discard))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &Discord{
+		Model:          "test-model",
+		MaxToolDepth:   3,
+		RequestTimeout: time.Minute,
+		openai:         b,
+	}
+	c.Kong = &kong.Context{Kong: k}
+	return c
+}
+
+func toolCall(id, name, args string) openai.ToolCall {
+	return openai.ToolCall{
+		ID:       id,
+		Type:     openai.ToolTypeFunction,
+		Function: openai.FunctionCall{Name: name, Arguments: args},
+	}
+}
+
+func callsTools(calls ...openai.ToolCall) openai.ChatCompletionMessage {
+	return openai.ChatCompletionMessage{Role: openai.ChatMessageRoleAssistant, ToolCalls: calls}
+}
+
+func answers(content string) openai.ChatCompletionMessage {
+	return openai.ChatCompletionMessage{Role: openai.ChatMessageRoleAssistant, Content: content}
+}
+
+var userMessage = []openai.ChatCompletionMessage{{Role: openai.ChatMessageRoleUser, Content: "hi"}}
+
+// toolResults returns the tool messages in the request, keyed by tool call ID
+func toolResults(request openai.ChatCompletionRequest) map[string]string {
+	results := map[string]string{}
+	for _, m := range request.Messages {
+		if m.Role == openai.ChatMessageRoleTool {
+			results[m.ToolCallID] = m.Content
+		}
+	}
+	return results
+}
+
+func TestToolLoopFeedsResultsBack(t *testing.T) {
+	b := &fakeBackend{responses: []openai.ChatCompletionMessage{
+		callsTools(
+			toolCall("1", "calculate", `{"expression": "2 + 3 * 4"}`),
+			toolCall("2", "current_time", `{"timezone": "UTC"}`),
+		),
+		answers("it's 14"),
+	}}
+	c := newTestDiscord(t, b)
+
+	if reply := c.makeChatRequestWithMessages("channel", userMessage); reply != "it's 14" {
+		t.Errorf("got reply %q, want %q", reply, "it's 14")
+	}
+	if len(b.requests) != 2 {
+		t.Fatalf("got %d requests, want 2", len(b.requests))
+	}
+	if len(b.requests[0].Tools) == 0 {
+		t.Errorf("first request had no tools")
+	}
+
+	second := b.requests[1]
+	if len(second.Messages) != 4 {
+		t.Fatalf("got %d messages in the second request, want the user's, the tool calls, and 2 results", len(second.Messages))
+	}
+	if len(second.Messages[1].ToolCalls) != 2 {
+		t.Errorf("the model's tool calls weren't sent back")
+	}
+	results := toolResults(second)
+	if results["1"] != "14" {
+		t.Errorf("got calculate result %q, want 14", results["1"])
+	}
+	if !strings.HasSuffix(results["2"], "UTC") {
+		t.Errorf("got current_time result %q, want a time in UTC", results["2"])
+	}
+	if len(userMessage) != 1 {
+		t.Errorf("the caller's messages were modified")
+	}
+}
+
+func TestToolLoopStopsAtMaxDepth(t *testing.T) {
+	for _, depth := range []int{0, 1, 3} {
+		t.Run(strconv.Itoa(depth), func(t *testing.T) {
+			b := &fakeBackend{}
+			for i := 0; i < depth; i++ {
+				b.responses = append(b.responses, callsTools(toolCall(strconv.Itoa(i), "roll_dice", `{"dice": "d6"}`)))
+			}
+			b.responses = append(b.responses, answers("done"))
+			c := newTestDiscord(t, b)
+			c.MaxToolDepth = depth
+
+			if reply := c.makeChatRequestWithMessages("channel", userMessage); reply != "done" {
+				t.Errorf("got reply %q, want %q", reply, "done")
+			}
+			if len(b.requests) != depth+1 {
+				t.Fatalf("got %d requests, want %d", len(b.requests), depth+1)
+			}
+			for i, request := range b.requests {
+				if hasTools := len(request.Tools) > 0; hasTools != (i < depth) {
+					t.Errorf("request %d offered tools: %v", i, hasTools)
+				}
+			}
+		})
+	}
+}
+
+func TestToolLoopReportsToolErrors(t *testing.T) {
+	b := &fakeBackend{responses: []openai.ChatCompletionMessage{
+		callsTools(
+			toolCall("unknown", "launch_rockets", `{}`),
+			toolCall("bad-args", "roll_dice", `{"dice": "a few"}`),
+			toolCall("bad-json", "calculate", `{"expression":`),
+		),
+		answers("sorry"),
+	}}
+	c := newTestDiscord(t, b)
+	c.makeChatRequestWithMessages("channel", userMessage)
+
+	if len(b.requests) != 2 {
+		t.Fatalf("got %d requests, want 2", len(b.requests))
+	}
+	results := toolResults(b.requests[1])
+	for id, want := range map[string]string{
+		"unknown":  "error: there's no tool called launch_rockets",
+		"bad-args": `error: "a few" isn't dice notation`,
+		"bad-json": "error: ",
+	} {
+		if !strings.HasPrefix(results[id], want) {
+			t.Errorf("got %s result %q, want it to start with %q", id, results[id], want)
+		}
+	}
+}
+
+func TestCalculate(t *testing.T) {
+	tests := []struct {
+		expression string
+		want       string
+		err        string
+	}{
+		{expression: "2 + 3 * 4", want: "14"},
+		{expression: "(2 + 3) * 4", want: "20"},
+		{expression: "-2 - -3", want: "1"},
+		{expression: "7 / 2", want: "3.5"},
+		{expression: "7 % 3", want: "1"},
+		{expression: "sqrt(16) + pow(2, 10)", want: "1028"},
+		{expression: "max(1, min(5, 3))", want: "3"},
+		{expression: "round(pi * 100)", want: "314"},
+		{expression: "1.5e3", want: "1500"},
+		{expression: "1 / 0", err: "division by zero"},
+		{expression: "sqrt(1, 2)", err: "expected 1 argument, got 2"},
+		{expression: "pow(2)", err: "expected 2 arguments, got 1"},
+		{expression: "exec(1)", err: "unknown function exec"},
+		{expression: "x + 1", err: "unknown name x"},
+		{expression: `"a" + "b"`, err: `unexpected "a"`},
+		{expression: "1 << 2", err: "unsupported operator <<"},
+		{expression: "!1", err: "unsupported operator !"},
+		{expression: "math.Sqrt(2)", err: "unsupported function call"},
+		{expression: "a[0]", err: "unsupported expression"},
+		{expression: "2 +", err: "invalid expression"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expression, func(t *testing.T) {
+			args, _ := json.Marshal(map[string]string{"expression": tt.expression})
+			got, err := calculate(nil, "", args)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Errorf("got %q, %v, want an error containing %q", got, err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+var rollRegex = regexp.MustCompile(`, total (-?\d+)$`)
+
+func TestRollDice(t *testing.T) {
+	tests := []struct {
+		dice     string
+		min, max int
+		err      bool
+	}{
+		{dice: "d20", min: 1, max: 20},
+		{dice: "2d6", min: 2, max: 12},
+		{dice: "2d6+3", min: 5, max: 15},
+		{dice: "3d8-1", min: 2, max: 23},
+		{dice: "1d2-5", min: -4, max: -3},
+		{dice: "2 D 6", min: 2, max: 12},
+		{dice: "100d1000", min: 100, max: 100000},
+		{dice: "0d6", err: true},
+		{dice: "101d6", err: true},
+		{dice: "1d1", err: true},
+		{dice: "d1001", err: true},
+		{dice: "d", err: true},
+		{dice: "2d6+", err: true},
+		{dice: "a few", err: true},
+		{dice: "", err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.dice, func(t *testing.T) {
+			args, _ := json.Marshal(map[string]string{"dice": tt.dice})
+			// roll a few times, since it's random
+			for i := 0; i < 20; i++ {
+				got, err := rollDice(nil, "", args)
+				if tt.err {
+					if err == nil {
+						t.Fatalf("got %q, want an error", got)
+					}
+					return
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				match := rollRegex.FindStringSubmatch(got)
+				if match == nil {
+					t.Fatalf("got %q, want a total", got)
+				}
+				total, _ := strconv.Atoi(match[1])
+				if total < tt.min || total > tt.max {
+					t.Fatalf("got total %d, want it in [%d, %d]", total, tt.min, tt.max)
+				}
+			}
+		})
+	}
+}
+
+// loopingBackend always asks for another tool call, even when it's not
+// offered any tools
+type loopingBackend struct {
+	fakeBackend
+	t *testing.T
+}
+
+func (l *loopingBackend) CreateChatCompletion(ctx context.Context, request openai.ChatCompletionRequest) (openai.ChatCompletionResponse, error) {
+	l.requests = append(l.requests, request)
+	if len(l.requests) > 10 {
+		l.t.Fatalf("the tool loop didn't stop after %d requests", len(l.requests))
+	}
+	return openai.ChatCompletionResponse{
+		Choices: []openai.ChatCompletionChoice{{Message: callsTools(toolCall(strconv.Itoa(len(l.requests)), "roll_dice", `{"dice": "d6"}`))}},
+	}, nil
+}
+
+func TestToolLoopStopsWhenToolCallsKeepComing(t *testing.T) {
+	for _, depth := range []int{0, 2} {
+		t.Run(strconv.Itoa(depth), func(t *testing.T) {
+			b := &loopingBackend{t: t}
+			c := newTestDiscord(t, b)
+			c.MaxToolDepth = depth
+
+			if reply := c.makeChatRequestWithMessages("channel", userMessage); reply != "" {
+				t.Errorf("got reply %q, want none", reply)
+			}
+			if len(b.requests) != depth+1 {
+				t.Errorf("got %d requests, want %d", len(b.requests), depth+1)
+			}
+			last := b.requests[len(b.requests)-1]
+			if results := toolResults(last); len(results) != depth {
+				t.Errorf("ran %d tool calls, want %d", len(results), depth)
+			}
+		})
+	}
+}
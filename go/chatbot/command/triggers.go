@@ -0,0 +1,179 @@
+package command
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+	openai "github.com/sashabaranov/go-openai"
+)
+
+// channel modes decide which messages in a channel the bot responds to:
+//
+//	always  - every message
+//	mention - messages that @-mention the bot or reply to one of its messages
+//	reply   - only replies to the bot's messages
+//	never   - nothing
+//
+// the chat channel defaults to always and any other channel to mention
+const (
+	modeAlways  = "always"
+	modeMention = "mention"
+	modeReply   = "reply"
+	modeNever   = "never"
+)
+
+var channelModes = []string{modeAlways, modeMention, modeReply, modeNever}
+
+func validChannelMode(mode string) bool {
+	for _, m := range channelModes {
+		if m == mode {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Discord) channelMode(channelID string) string {
+	c.channelModesMu.Lock()
+	mode, ok := c.ChannelModes[channelID]
+	c.channelModesMu.Unlock()
+	if ok {
+		return mode
+	}
+	if channelID == c.ChatChannel {
+		return modeAlways
+	}
+	return modeMention
+}
+
+// triggered is whether the message should get a response according to its
+// channel's mode
+func (c *Discord) triggered(s *discordgo.Session, m *discordgo.MessageCreate) bool {
+	switch c.channelMode(m.ChannelID) {
+	case modeAlways:
+		return true
+	case modeMention:
+		return mentions(s, m) || repliesToBot(s, m)
+	case modeReply:
+		return repliesToBot(s, m)
+	default:
+		return false
+	}
+}
+
+func mentions(s *discordgo.Session, m *discordgo.MessageCreate) bool {
+	for _, u := range m.Mentions {
+		if u.ID == s.State.User.ID {
+			return true
+		}
+	}
+	return false
+}
+
+func repliesToBot(s *discordgo.Session, m *discordgo.MessageCreate) bool {
+	ref := referencedMessage(s, m)
+	return ref != nil && ref.Author != nil && ref.Author.ID == s.State.User.ID
+}
+
+// referencedMessage returns the message this one replies to, if any. Discord
+// usually includes it, but not always.
+func referencedMessage(s *discordgo.Session, m *discordgo.MessageCreate) *discordgo.Message {
+	if m.MessageReference == nil {
+		return nil
+	}
+	if m.ReferencedMessage == nil {
+		ref, err := s.ChannelMessage(m.MessageReference.ChannelID, m.MessageReference.MessageID)
+		if err != nil {
+			fmt.Printf("error getting referenced message: %v\n", err)
+			return nil
+		}
+		m.ReferencedMessage = ref
+	}
+	return m.ReferencedMessage
+}
+
+// chatMessage converts a Discord message into one for the model, with the
+// author's name prepended for anyone but the bot
+func (c *Discord) chatMessage(s *discordgo.Session, m *discordgo.Message) openai.ChatCompletionMessage {
+	content := c.normalizeMentions(s, m)
+
+	if m.Author.ID == s.State.User.ID {
+		return openai.ChatCompletionMessage{Role: openai.ChatMessageRoleAssistant, Content: content}
+	}
+	return c.withAttachments(openai.ChatCompletionMessage{
+		Role:    openai.ChatMessageRoleUser,
+		Content: fmt.Sprintf("%s: %s", c.username(m.Author.ID), content),
+	}, m)
+}
+
+// respondDirectly replies to a message outside of the chat channel's running
+// conversation, with just the current prompt and whatever the message replies
+// to as context
+func (c *Discord) respondDirectly(s *discordgo.Session, m *discordgo.MessageCreate) {
+	personality := c.personalityFor(m.Author.ID)
+	messages := []openai.ChatCompletionMessage{{
+		Role:    openai.ChatMessageRoleSystem,
+		Content: c.prompts.Personalities[personality],
+	}}
+	users := map[string]bool{m.Author.ID: true}
+	if ref := referencedMessage(s, m); ref != nil {
+		messages = append(messages, c.chatMessage(s, ref))
+		users[ref.Author.ID] = true
+	}
+	messages = append(messages, c.chatMessage(s, m.Message))
+
+	_ = s.ChannelTyping(m.ChannelID)
+	reply := c.makeChatRequestWithMessages(m.ChannelID, c.withKnowledge(personality, c.withMemories(messages, users)))
+	if reply == "" {
+		return
+	}
+	if err := c.sendReply(m.ChannelID, reply, m.Reference()); err != nil {
+		fmt.Printf("error sending message: %v\n", err)
+	}
+}
+
+// setChannelMode handles .channel [channel] [mode]
+func (c *Discord) setChannelMode(args string) string {
+	fields := strings.Fields(args)
+	if len(fields) == 0 {
+		lines := []string{
+			fmt.Sprintf("%s: %s (chat channel)", c.ChatChannel, c.channelMode(c.ChatChannel)),
+		}
+		c.channelModesMu.Lock()
+		ids := []string{}
+		for id := range c.ChannelModes {
+			if id != c.ChatChannel {
+				ids = append(ids, id)
+			}
+		}
+		sort.Strings(ids)
+		for _, id := range ids {
+			lines = append(lines, fmt.Sprintf("%s: %s", id, c.ChannelModes[id]))
+		}
+		c.channelModesMu.Unlock()
+		lines = append(lines, fmt.Sprintf("anywhere else: %s", modeMention))
+		return strings.Join(lines, "\n")
+	}
+	if len(fields) != 2 {
+		return "usage: .channel [channel] [mode]"
+	}
+
+	// accept #channel mentions too
+	id := strings.TrimSuffix(strings.TrimPrefix(fields[0], "<#"), ">")
+	mode := fields[1]
+	if !validChannelMode(mode) {
+		return fmt.Sprintf("unknown mode, valid modes are: %s", strings.Join(channelModes, ", "))
+	}
+	if id == c.ManagementChannel {
+		return "the management channel is for commands only"
+	}
+	c.channelModesMu.Lock()
+	if c.ChannelModes == nil {
+		c.ChannelModes = map[string]string{}
+	}
+	c.ChannelModes[id] = mode
+	c.channelModesMu.Unlock()
+	return fmt.Sprintf("set mode of %s to %s", id, mode)
+}
@@ -0,0 +1,246 @@
+package command
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"gopkg.in/yaml.v3"
+)
+
+// user is what the users file knows about someone, keyed by their Discord ID.
+// it's YAML, or JSON since that's YAML too.
+type user struct {
+	Name        string   `yaml:"name" json:"name"`
+	Aliases     []string `yaml:"aliases,omitempty" json:"aliases,omitempty"`
+	Pronouns    string   `yaml:"pronouns,omitempty" json:"pronouns,omitempty"`
+	Blocked     bool     `yaml:"blocked,omitempty" json:"blocked,omitempty"` // the bot ignores them
+	Personality string   `yaml:"personality,omitempty" json:"personality,omitempty"`
+
+	legacy string // the old format's value, kept until the user is edited
+}
+
+// UnmarshalYAML also accepts the old format of just a name, where anything
+// after a dash was ignored, e.g. andrey-k
+func (u *user) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		name, _, _ := strings.Cut(node.Value, "-")
+		r, size := utf8.DecodeRuneInString(name)
+		u.Name = string(unicode.ToUpper(r)) + name[size:]
+		u.legacy = node.Value
+		return nil
+	}
+	type plain user
+	return node.Decode((*plain)(u))
+}
+
+// MarshalYAML and MarshalJSON write users in the old format back as they
+// were, so saving doesn't lose what came after the dash
+func (u *user) MarshalYAML() (any, error) {
+	if u.legacy != "" {
+		return u.legacy, nil
+	}
+	type plain user
+	return (*plain)(u), nil
+}
+
+func (u *user) MarshalJSON() ([]byte, error) {
+	if u.legacy != "" {
+		return json.Marshal(u.legacy)
+	}
+	type plain user
+	return json.Marshal((*plain)(u))
+}
+
+func (c *Discord) parseUsers() error {
+	b, err := io.ReadAll(c.Users)
+	if err != nil {
+		return err
+	}
+	// remember whether it's JSON, so it's saved the same way
+	c.usersJSON = json.Valid(bytes.TrimSpace(b))
+	c.users = map[string]*user{}
+	if err := yaml.Unmarshal(b, &c.users); err != nil {
+		return fmt.Errorf("parsing users file: %w", err)
+	}
+	for id, u := range c.users {
+		if u == nil || u.Name == "" {
+			return fmt.Errorf("user %s has no name", id)
+		}
+		if u.Personality != "" {
+			if _, ok := c.prompts.Personalities[u.Personality]; !ok {
+				return fmt.Errorf("user %s has an unknown personality %s", id, u.Personality)
+			}
+		}
+	}
+	return nil
+}
+
+// saveUsers writes the users back to the users file in the format it was
+// in, so that edits from the management channel survive restarts. its only
+// caller, handleUsersCommand, holds the users lock.
+func (c *Discord) saveUsers() error {
+	var b []byte
+	var err error
+	if c.usersJSON {
+		b, err = json.MarshalIndent(c.users, "", "  ")
+		b = append(b, '\n')
+	} else {
+		b, err = yaml.Marshal(c.users)
+	}
+	if err != nil {
+		return err
+	}
+	return writeFile(c.Users.Name(), b)
+}
+
+// lookupUser returns a copy of what the users file knows about someone, since
+// the users can be edited while we're reading them
+func (c *Discord) lookupUser(id string) (user, bool) {
+	c.usersMu.Lock()
+	defer c.usersMu.Unlock()
+	u, ok := c.users[id]
+	if !ok {
+		return user{}, false
+	}
+	return *u, true
+}
+
+// knownUsers returns a copy of everyone in the users file
+func (c *Discord) knownUsers() map[string]user {
+	c.usersMu.Lock()
+	defer c.usersMu.Unlock()
+	users := make(map[string]user, len(c.users))
+	for id, u := range c.users {
+		users[id] = *u
+	}
+	return users
+}
+
+// username is what to call someone, from the users file, falling back to
+// their nickname or username in any guild we share
+func (c *Discord) username(id string) string {
+	if u, ok := c.lookupUser(id); ok {
+		return u.Name
+	}
+	for _, g := range c.discord.State.Guilds {
+		member, err := c.discord.State.Member(g.ID, id)
+		if err != nil {
+			if member, err = c.discord.GuildMember(g.ID, id); err != nil {
+				continue
+			}
+			member.GuildID = g.ID
+			_ = c.discord.State.MemberAdd(member)
+		}
+		if member.Nick != "" {
+			return member.Nick
+		}
+		if member.User != nil {
+			return member.User.Username
+		}
+	}
+	return id
+}
+
+func (c *Discord) blocked(id string) bool {
+	u, ok := c.lookupUser(id)
+	return ok && u.Blocked
+}
+
+// personalityFor is the user's preferred personality, or the current one
+func (c *Discord) personalityFor(id string) string {
+	if u, ok := c.lookupUser(id); ok && u.Personality != "" {
+		return u.Personality
+	}
+	return c.personality
+}
+
+// handleUsersCommand handles .users, .users add <id> <name>, .users rm <id>
+// and .users set <id> <key> <value>
+func (c *Discord) handleUsersCommand(args string) string {
+	c.usersMu.Lock()
+	defer c.usersMu.Unlock()
+
+	fields := strings.Fields(args)
+	if len(fields) == 0 {
+		b, _ := yaml.Marshal(c.users)
+		return string(b)
+	}
+	if len(fields) < 2 {
+		return "usage: .users [add|rm|set] <id> ..."
+	}
+	sub := fields[0]
+	id := strings.TrimSuffix(strings.TrimPrefix(strings.TrimPrefix(fields[1], "<@"), "!"), ">")
+
+	switch sub {
+	case "add":
+		if len(fields) < 3 {
+			return "usage: .users add <id> <name>"
+		}
+		if _, ok := c.users[id]; ok {
+			return fmt.Sprintf("user %s already exists, use .users set", id)
+		}
+		c.users[id] = &user{Name: strings.Join(fields[2:], " ")}
+	case "rm":
+		if _, ok := c.users[id]; !ok {
+			return fmt.Sprintf("user %s does not exist", id)
+		}
+		delete(c.users, id)
+	case "set":
+		if len(fields) < 4 {
+			return "usage: .users set <id> <key> <value>"
+		}
+		u, ok := c.users[id]
+		if !ok {
+			return fmt.Sprintf("user %s does not exist, use .users add", id)
+		}
+		if msg := u.set(c, fields[2], strings.Join(fields[3:], " ")); msg != "" {
+			return msg
+		}
+	default:
+		return "usage: .users [add|rm|set] <id> ..."
+	}
+
+	if err := c.saveUsers(); err != nil {
+		return fmt.Sprintf("updated user %s, but couldn't save the users file: %v", id, err)
+	}
+	return fmt.Sprintf("updated user %s", id)
+}
+
+// set sets one of the user's fields, returning why it couldn't. once it's
+// been set, the user is saved in the new format.
+func (u *user) set(c *Discord, key, val string) string {
+	switch key {
+	case "name":
+		u.Name = val
+	case "aliases":
+		u.Aliases = nil
+		for _, alias := range strings.Split(val, ",") {
+			if alias = strings.TrimSpace(alias); alias != "" {
+				u.Aliases = append(u.Aliases, alias)
+			}
+		}
+	case "pronouns":
+		u.Pronouns = val
+	case "blocked":
+		b, err := strconv.ParseBool(val)
+		if err != nil {
+			return fmt.Sprintf("error parsing blocked: %v", err)
+		}
+		u.Blocked = b
+	case "personality":
+		if _, ok := c.prompts.Personalities[val]; !ok {
+			return "please provide a valid prompt name"
+		}
+		u.Personality = val
+	default:
+		return "unknown key, valid keys are: name, aliases, pronouns, blocked, personality"
+	}
+	u.legacy = ""
+	return ""
+}
@@ -0,0 +1,183 @@
+package command
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"time"
+)
+
+// backupConfig configures backups of a server's world
+type backupConfig struct {
+	OnStop bool   `yaml:"on_stop"` // back up every time the server's deallocated
+	Retain int    `yaml:"retain"`  // how many backups to keep
+	Hook   string `yaml:"hook"`    // a command to back up with instead of disk snapshots
+}
+
+type backup struct {
+	ID      string
+	Created time.Time
+}
+
+// BackupProvider backs up and restores a server's world. restoring expects
+// the server to be deallocated.
+type BackupProvider interface {
+	CreateBackup(ctx context.Context, s *server) (*backup, error)
+	ListBackups(ctx context.Context, s *server) ([]*backup, error)
+	DeleteBackup(ctx context.Context, s *server, id string) error
+	RestoreBackup(ctx context.Context, s *server, id string) error
+}
+
+const defaultBackupRetain = 5
+
+func (c *Discord) backupProvider(s *server) (BackupProvider, error) {
+	if s.Backup.Hook != "" {
+		return &hookBackups{command: s.Backup.Hook}, nil
+	}
+	if p, ok := c.provider.(BackupProvider); ok {
+		return p, nil
+	}
+	return nil, fmt.Errorf("%s can't be backed up without a backup hook", s.Name)
+}
+
+// backupServer backs up the server and prunes its old backups
+func (c *Discord) backupServer(ctx context.Context, s *server) (*backup, error) {
+	p, err := c.backupProvider(s)
+	if err != nil {
+		return nil, err
+	}
+	b, err := p.CreateBackup(ctx, s)
+	if err != nil {
+		return nil, fmt.Errorf("backing up: %w", err)
+	}
+
+	backups, err := c.listBackups(ctx, s)
+	if err != nil {
+		return b, fmt.Errorf("listing backups to prune: %w", err)
+	}
+	for i := s.Backup.Retain; i < len(backups); i++ {
+		c.Kong.Printf("pruning backup %s of %s", backups[i].ID, s.Host)
+		if err := p.DeleteBackup(ctx, s, backups[i].ID); err != nil {
+			return b, fmt.Errorf("pruning backup %s: %w", backups[i].ID, err)
+		}
+	}
+	return b, nil
+}
+
+// listBackups returns the server's backups, newest first
+func (c *Discord) listBackups(ctx context.Context, s *server) ([]*backup, error) {
+	p, err := c.backupProvider(s)
+	if err != nil {
+		return nil, err
+	}
+	backups, err := p.ListBackups(ctx, s)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(backups, func(i, j int) bool {
+		return backups[i].Created.After(backups[j].Created)
+	})
+	return backups, nil
+}
+
+func (c *Discord) backupsReport(s *server) (string, error) {
+	backups, err := c.listBackups(c.opCtx, s)
+	if err != nil {
+		return "", err
+	}
+	if len(backups) == 0 {
+		return fmt.Sprintf("%s has no backups", s.Name), nil
+	}
+	lines := []string{fmt.Sprintf("backups of %s, newest first:", s.Name)}
+	for _, b := range backups {
+		lines = append(lines, fmt.Sprintf("%s (%s)", b.ID, b.Created.Local().Format(time.RFC1123)))
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+func (c *Discord) restoreServer(s *server, id string) (string, error) {
+	done, err := c.beginOp()
+	if err != nil {
+		return "", err
+	}
+	defer done()
+
+	state, err := powerState(c.opCtx, c.provider, s)
+	if err != nil {
+		return "", err
+	}
+	if state != "deallocated" {
+		return fmt.Sprintf("%s is %s, stop it before restoring", s.Name, state), nil
+	}
+	p, err := c.backupProvider(s)
+	if err != nil {
+		return "", err
+	}
+	if err := p.RestoreBackup(c.opCtx, s, id); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("restored %s from %s, start it whenever", s.Name, id), nil
+}
+
+// hookBackups backs up by running a command, e.g. for servers in containers.
+// the command gets the server's name in $SERVER, what to do in $ACTION
+// (create, list, delete or restore), and the backup in $BACKUP_ID for delete
+// and restore. create should print the new backup's ID, and list should print
+// a line per backup of its ID and RFC 3339 creation time.
+type hookBackups struct {
+	command string
+}
+
+func (h *hookBackups) run(ctx context.Context, s *server, action, id string) (string, error) {
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", h.command)
+	cmd.Env = append(os.Environ(), "SERVER="+s.Name, "ACTION="+action, "BACKUP_ID="+id)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		err = fmt.Errorf("exec: %s: %w; output:\n%s", h.command, err, out)
+	}
+	return strings.TrimSpace(string(out)), err
+}
+
+func (h *hookBackups) CreateBackup(ctx context.Context, s *server) (*backup, error) {
+	out, err := h.run(ctx, s, "create", "")
+	if err != nil {
+		return nil, err
+	}
+	lines := strings.Split(out, "\n")
+	return &backup{ID: strings.TrimSpace(lines[len(lines)-1]), Created: time.Now()}, nil
+}
+
+func (h *hookBackups) ListBackups(ctx context.Context, s *server) ([]*backup, error) {
+	out, err := h.run(ctx, s, "list", "")
+	if err != nil {
+		return nil, err
+	}
+	backups := []*backup{}
+	scanner := bufio.NewScanner(strings.NewReader(out))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		created, err := time.Parse(time.RFC3339, fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("parsing backup %s: %w", fields[0], err)
+		}
+		backups = append(backups, &backup{ID: fields[0], Created: created})
+	}
+	return backups, nil
+}
+
+func (h *hookBackups) DeleteBackup(ctx context.Context, s *server, id string) error {
+	_, err := h.run(ctx, s, "delete", id)
+	return err
+}
+
+func (h *hookBackups) RestoreBackup(ctx context.Context, s *server, id string) error {
+	_, err := h.run(ctx, s, "restore", id)
+	return err
+}
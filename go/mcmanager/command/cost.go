@@ -0,0 +1,216 @@
+package command
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// usageSession is a stretch of time a server was running. Stop is zero while
+// it's still running.
+type usageSession struct {
+	Start time.Time `json:"start"`
+	Stop  time.Time `json:"stop,omitempty"`
+}
+
+// usageLedger records when servers were started and stopped so we can work
+// out how long they've run, and so how much they've cost. it's written to
+// path on every change if a path is set.
+type usageLedger struct {
+	mu       sync.Mutex
+	path     string
+	logf     func(format string, args ...any)
+	Sessions map[string][]*usageSession `json:"sessions"` // keyed by server name
+}
+
+// loadUsageLedger reads the ledger at path. a corrupt one is moved aside
+// rather than overwritten, so its history can still be recovered by hand.
+func loadUsageLedger(path string, logf func(format string, args ...any)) (*usageLedger, error) {
+	l := &usageLedger{path: path, logf: logf, Sessions: map[string][]*usageSession{}}
+	if path == "" {
+		return l, nil
+	}
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return l, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, l); err != nil {
+		corrupt := path + ".corrupt"
+		logf("usage file %s couldn't be parsed, moving it to %s and starting over: %s", path, corrupt, err)
+		if err := os.Rename(path, corrupt); err != nil {
+			return nil, err
+		}
+		l.Sessions = nil
+	}
+	if l.Sessions == nil {
+		l.Sessions = map[string][]*usageSession{}
+	}
+	return l, nil
+}
+
+func (l *usageLedger) save() error {
+	if l.path == "" {
+		return nil
+	}
+	b, err := json.MarshalIndent(l, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFile(l.path, b)
+}
+
+func (l *usageLedger) started(name string, t time.Time) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	sessions := l.Sessions[name]
+	if n := len(sessions); n > 0 && sessions[n-1].Stop.IsZero() {
+		return
+	}
+	l.Sessions[name] = append(sessions, &usageSession{Start: t})
+	if err := l.save(); err != nil {
+		l.logf("error saving usage: %s", err)
+	}
+}
+
+func (l *usageLedger) stopped(name string, t time.Time) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	sessions := l.Sessions[name]
+	n := len(sessions)
+	if n == 0 || !sessions[n-1].Stop.IsZero() {
+		return
+	}
+	sessions[n-1].Stop = t
+	if err := l.save(); err != nil {
+		l.logf("error saving usage: %s", err)
+	}
+}
+
+// runningTime returns how long the server ran between from and to
+func (l *usageLedger) runningTime(name string, from, to time.Time) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var total time.Duration
+	for _, session := range l.Sessions[name] {
+		start, stop := session.Start, session.Stop
+		if stop.IsZero() {
+			stop = time.Now()
+		}
+		if start.Before(from) {
+			start = from
+		}
+		if stop.After(to) {
+			stop = to
+		}
+		if stop.After(start) {
+			total += stop.Sub(start)
+		}
+	}
+	return total
+}
+
+func monthBounds(month time.Time) (time.Time, time.Time) {
+	start := time.Date(month.Year(), month.Month(), 1, 0, 0, 0, 0, month.Location())
+	return start, start.AddDate(0, 1, 0)
+}
+
+func (c *Discord) monthlyCost(s *server, month time.Time) (time.Duration, float64) {
+	from, to := monthBounds(month)
+	running := c.usage.runningTime(s.Name, from, to)
+	return running, running.Hours() * s.HourlyRate
+}
+
+func (c *Discord) overBudget(s *server) bool {
+	if s.MonthlyBudget <= 0 {
+		return false
+	}
+	_, cost := c.monthlyCost(s, time.Now())
+	return cost >= s.MonthlyBudget
+}
+
+// canOverrideBudget reports whether the message author has the role that's
+// allowed to start servers that are over budget
+func (c *Discord) canOverrideBudget(m *discordgo.MessageCreate) bool {
+	role := c.config().BudgetOverrideRole
+	if role == "" || m.Member == nil {
+		return false
+	}
+	for _, r := range m.Member.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// costReport handles the args of .cost, i.e. an optional server and an
+// optional month like 2006-01, in any order
+func (c *Discord) costReport(args string) (string, error) {
+	month := time.Now()
+	servers := c.servers()
+	for _, arg := range strings.Fields(args) {
+		if t, err := time.ParseInLocation("2006-01", arg, time.Local); err == nil {
+			month = t
+			continue
+		}
+		s, err := c.findServer(arg)
+		if err != nil {
+			return "", err
+		}
+		servers = []*server{s}
+	}
+
+	lines := []string{fmt.Sprintf("usage for %s:", month.Format("January 2006"))}
+	var total float64
+	for _, s := range servers {
+		running, cost := c.monthlyCost(s, month)
+		total += cost
+		line := fmt.Sprintf("%s: %.1fh, $%.2f", s.Name, running.Hours(), cost)
+		if s.MonthlyBudget > 0 {
+			line += fmt.Sprintf(" (budget $%.2f)", s.MonthlyBudget)
+		}
+		lines = append(lines, line)
+	}
+	if len(servers) == 1 {
+		lines = append(lines, c.dailyUsage(servers[0], month)...)
+	} else {
+		lines = append(lines, fmt.Sprintf("total: $%.2f", total))
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+func (c *Discord) dailyUsage(s *server, month time.Time) []string {
+	from, to := monthBounds(month)
+	days := map[string]time.Duration{}
+	for day := from; day.Before(to); day = day.AddDate(0, 0, 1) {
+		if running := c.usage.runningTime(s.Name, day, day.AddDate(0, 0, 1)); running > 0 {
+			days[day.Format("2006-01-02")] = running
+		}
+	}
+	keys := make([]string, 0, len(days))
+	for k := range days {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	lines := []string{}
+	for _, k := range keys {
+		lines = append(lines, fmt.Sprintf("  %s: %.1fh, $%.2f", k, days[k].Hours(), days[k].Hours()*s.HourlyRate))
+	}
+	return lines
+}
@@ -3,11 +3,12 @@ package command
 import (
 	"context"
 	"fmt"
-	"io"
 	"net/http"
 	"os"
+	"os/signal"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
@@ -15,7 +16,6 @@ import (
 	"github.com/bradleyfalzon/ghinstallation/v2"
 	"github.com/bwmarrin/discordgo"
 	"github.com/google/go-github/v57/github"
-	"gopkg.in/yaml.v3"
 )
 
 type Discord struct {
@@ -23,16 +23,38 @@ type Discord struct {
 
 	DiscordToken      string `required:"" env:"DISCORD_TOKEN"`
 	ManagementChannel string `required:"" env:"MGMT_CHANNEL" name:"mgmt-channel" help:"A channel ID to listen for management commands in"`
+	StatusChannel     string `optional:"" env:"STATUS_CHANNEL" name:"status-channel" help:"A channel ID to keep a pinned, live server status message in"`
 	discord           *discordgo.Session
+	statusMu          sync.Mutex
+	statusMessageID   string
+	confirmations     map[string]chan confirmAnswer // keyed by prompt message ID
+	confirmMu         sync.Mutex
 
 	AzureTenantID       string `required:"" env:"AZURE_TENANT_ID" help:"The Azure Tenant ID"`
 	AzureClientID       string `required:"" env:"AZURE_CLIENT_ID" help:"The Azure Client ID"`
 	AzureClientSecret   string `required:"" env:"AZURE_CLIENT_SECRET" help:"The Azure Client Secret"`
 	AzureSubscriptionID string `required:"" env:"AZURE_SUBSCRIPTION_ID" help:"The Azure Subscription ID"`
-	vmClient            *armcompute.VirtualMachinesClient
+	provider            ComputeProvider
 
-	ServersFile  *os.File `required:"" env:"SERVERS_FILE" help:"A path to a file containing the servers to monitor"`
-	serverConfig *serverConfig
+	ServersFile              string        `required:"" type:"existingfile" env:"SERVERS_FILE" help:"A path to a file containing the servers to monitor"`
+	ServersFileCheckInterval time.Duration `optional:"" default:"30s" env:"SERVERS_FILE_CHECK_INTERVAL" help:"How often to check the servers file for changes"`
+	serverConfig             *serverConfig
+	configMu                 sync.RWMutex
+	monitors                 map[string]context.CancelFunc // keyed by server name
+	reloadMu                 sync.Mutex
+
+	ShutdownTimeout time.Duration      `optional:"" default:"2m" env:"SHUTDOWN_TIMEOUT" help:"How long to wait for servers that are starting or stopping before exiting"`
+	ctx             context.Context    // cancelled on SIGINT/SIGTERM
+	opCtx           context.Context    // for starts and stops, outlives ctx until the shutdown timeout
+	cancelOps       context.CancelFunc // detaches from in-flight starts and stops
+	monitorWG       sync.WaitGroup
+	inflight        sync.WaitGroup
+	shuttingDown    bool // once set, nothing more is added to inflight
+	shutdownMu      sync.Mutex
+	UsageFile       string `optional:"" type:"path" env:"USAGE_FILE" help:"A path to a file to record server running times in, for cost tracking"`
+	usage           *usageLedger
+	StateFile       string `optional:"" type:"path" env:"STATE_FILE" help:"A path to a file to persist server state in across restarts"`
+	stateMu         sync.Mutex
 
 	// unused
 	AppID          int64  `hidden:"" env:"GH_APP_ID" help:"The GitHub App ID"`
@@ -45,6 +67,8 @@ func (c *Discord) setupDiscord() {
 	c.Kong.FatalIfErrorf(err, "failed creating Discord session")
 
 	dg.AddHandler(c.onMessageCreate)
+	dg.AddHandler(c.onMessageReactionAdd)
+	dg.AddHandler(c.onInteractionCreate)
 	dg.Identify.Intents |= discordgo.IntentsAllWithoutPrivileged
 	dg.Identify.Intents |= discordgo.IntentsMessageContent
 	err = dg.Open()
@@ -56,8 +80,13 @@ func (c *Discord) setupAzure() {
 	creds, err := azidentity.NewDefaultAzureCredential(nil)
 	c.Kong.FatalIfErrorf(err, "failed getting credentials")
 
-	c.vmClient, err = armcompute.NewVirtualMachinesClient(c.AzureSubscriptionID, creds, nil)
+	vms, err := armcompute.NewVirtualMachinesClient(c.AzureSubscriptionID, creds, nil)
 	c.Kong.FatalIfErrorf(err, "failed creating vm client")
+	disks, err := armcompute.NewDisksClient(c.AzureSubscriptionID, creds, nil)
+	c.Kong.FatalIfErrorf(err, "failed creating disk client")
+	snapshots, err := armcompute.NewSnapshotsClient(c.AzureSubscriptionID, creds, nil)
+	c.Kong.FatalIfErrorf(err, "failed creating snapshot client")
+	c.provider = &azureProvider{vms: vms, disks: disks, snapshots: snapshots}
 }
 
 func (c *Discord) AfterApply() error {
@@ -67,98 +96,154 @@ func (c *Discord) AfterApply() error {
 }
 
 func (c *Discord) Run() error {
-	rawServers, err := io.ReadAll(c.ServersFile)
-	if err != nil {
+	var stop context.CancelFunc
+	c.ctx, stop = signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM, os.Interrupt)
+	defer stop()
+	c.opCtx, c.cancelOps = context.WithCancel(context.Background())
+	defer c.cancelOps()
+
+	var err error
+	if c.usage, err = loadUsageLedger(c.UsageFile, func(format string, args ...any) { c.Kong.Printf(format, args...) }); err != nil {
 		return err
 	}
-	if err := yaml.Unmarshal(rawServers, &c.serverConfig); err != nil {
+	if c.serverConfig, err = c.loadServerConfig(); err != nil {
 		return err
 	}
-	if err := c.setConfigDefaults(); err != nil {
+	if err := c.loadState(); err != nil {
 		return err
 	}
+	c.reconcile()
+
+	c.monitors = map[string]context.CancelFunc{}
+	for _, s := range c.servers() {
+		c.startMonitoring(s)
+	}
+	c.watchServersFile()
+	c.shutdown()
+	return nil
+}
+
+// startMonitoring spawns the goroutines that watch over a server until
+// stopMonitoring is called for it
+func (c *Discord) startMonitoring(s *server) {
+	ctx, cancel := context.WithCancel(c.ctx)
+	c.monitors[s.Name] = cancel
+
+	c.monitorWG.Add(1)
+	go func() {
+		defer c.monitorWG.Done()
+		ticker := time.NewTicker(s.CheckInterval)
+		defer ticker.Stop()
+		for {
+			c.deallocateCondionally(s)
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
 
-	wg := sync.WaitGroup{}
-	for _, s := range c.serverConfig.Servers {
-		wg.Add(1)
-		go func(s *server) {
-			defer wg.Done()
-			ticker := time.NewTicker(s.CheckInterval)
-			defer ticker.Stop()
-			for ; true; <-ticker.C {
-				c.deallocateCondionally(s)
+	// periodically check if the server is online because it might
+	// have been started outside of the typical .start/.stop
+	// discord commands (e.g. via a Terraform apply, az start, from
+	// the UI). it's mostly a safeguard.
+	c.monitorWG.Add(1)
+	go func() {
+		defer c.monitorWG.Done()
+		ticker := time.NewTicker(1 * time.Hour)
+		defer ticker.Stop()
+		for {
+			c.Kong.Printf("periodic check of server's online status: %s", s.Host)
+			if _, err := c.checkServer(s); err == nil {
+				s.markOnline()
+			} else {
+				s.markOffline()
 			}
-		}(s)
-
-		// periodically check if the server is online because it might
-		// have been started outside of the typical .start/.stop
-		// discord commands (e.g. via a Terraform apply, az start, from
-		// the UI). it's mostly a safeguard.
-		wg.Add(1)
-		go func(s *server) {
-			defer wg.Done()
-			ticker := time.NewTicker(1 * time.Hour)
-			defer ticker.Stop()
-			for ; true; <-ticker.C {
-				c.Kong.Printf("periodic check of server's online status: %s", s.Host)
-				s.online = false
-				if _, err := c.checkServer(s); err == nil {
-					s.online = true
-				}
+			c.stateChanged()
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
 			}
-		}(s)
+		}
+	}()
+
+	if s.Schedule != nil {
+		c.monitorWG.Add(1)
+		go func() {
+			defer c.monitorWG.Done()
+			c.runSchedule(ctx, s)
+		}()
+	}
+}
+
+func (c *Discord) stopMonitoring(s *server) {
+	if cancel, ok := c.monitors[s.Name]; ok {
+		cancel()
+		delete(c.monitors, s.Name)
 	}
-	wg.Wait()
-	return nil
 }
 
-// will only deallocate if the server has errored or has zero players for
-// consecutive checks equal to the deallocation threshold
+// checks the server and deallocates it if its idle policy says so, or if
+// it's over budget
 func (c *Discord) deallocateCondionally(s *server) {
-	if !s.online {
+	if !s.isOnline() {
 		return
 	}
+	defer c.stateChanged()
 
 	c.Kong.Printf("checking server: %s", s.Host)
+	now := time.Now()
 	pong, err := c.checkServer(s)
 	if err != nil {
 		c.Kong.Printf("error checking server: %s: %s", s.Host, err)
-		s.checkErrors++
 	} else {
-		s.online = true
-		switch pong.PlayerCount {
-		case 0:
-			s.checkCount++
-			msg := fmt.Sprintf("%s has no players online (check count: %d)", s.Host, s.checkCount)
-			c.Kong.Printf(msg)
-			// _ = c.sendMessagef(msg)
-		default:
-			s.checkCount = 0
-			s.checkErrors = 0
-		}
+		s.markOnline()
+	}
+	s.IdlePolicy.record(s, pong, err, now)
+	if err == nil && pong.PlayerCount == 0 {
+		c.Kong.Printf("%s has no players online (check count: %d)", s.Host, s.runtime().checkCount)
 	}
 
-	var msg string
-	if s.checkErrors >= s.DeallocationThreshold {
-		msg = fmt.Sprintf("%s deallocating because it had %d consecutive errors", s.Host, s.DeallocationThreshold)
-		s.online = false
+	if c.overBudget(s) {
+		msg := fmt.Sprintf("%s deallocating because it's over its monthly budget of $%.2f", s.Host, s.MonthlyBudget)
+		c.Kong.Printf(msg)
+		s.markOffline()
+		_ = c.sendFormatted(formatNotice(s, msg))
+		c.inBackground(func() { _, _ = c.deallocateServer(s, true) })
+		return
 	}
-	if s.checkCount >= s.DeallocationThreshold {
-		total := time.Duration(s.DeallocationThreshold) * s.CheckInterval
-		msg = fmt.Sprintf("%s deallocating because it had no players for %s", s.Host, total)
-		s.online = false
+
+	if s.held() {
+		c.Kong.Printf("%s is held until %s, not counting towards deallocation", s.Host, s.heldUntil())
+		s.resetCounts()
+		s.clearWarning()
+		return
+	}
+
+	reason := s.IdlePolicy.evaluate(s, now)
+	if reason == "" {
+		c.warnIfIdle(s)
+		return
 	}
 
-	// we've mark errored servers or servers with no online
-	// players as offline before deallocation so we don't
-	// try to check them again
-	if !s.online {
+	if s.IdlePolicy.DryRun {
+		msg := fmt.Sprintf("dry run: %s would be deallocated because %s", s.Host, reason)
 		c.Kong.Printf(msg)
-		_ = c.sendMessagef(msg)
-		go c.deallocateServer(s)
+		_ = c.sendFormatted(formatNotice(s, msg))
+		// start counting over so we only announce once per threshold
+		s.resetCounts()
+		return
 	}
 
-	// c.Kong.Printf(pong.Pretty())
+	// mark the server as offline before deallocation so we don't try to
+	// check it again
+	msg := fmt.Sprintf("%s deallocating because %s", s.Host, reason)
+	c.Kong.Printf(msg)
+	s.markOffline()
+	_ = c.sendFormatted(formatNotice(s, msg))
+	c.inBackground(func() { _, _ = c.deallocateServer(s, false) })
 }
 
 func (c *Discord) onMessageCreate(s *discordgo.Session, m *discordgo.MessageCreate) {
@@ -180,6 +265,7 @@ func (c *Discord) onMessageCreate(s *discordgo.Session, m *discordgo.MessageCrea
 	}
 
 	var msg string
+	var reply *formatted
 	switch cmd {
 	case ".help":
 		msg = `
@@ -187,9 +273,15 @@ func (c *Discord) onMessageCreate(s *discordgo.Session, m *discordgo.MessageCrea
 .ping - pong
 .uptime - show uptime of this bot
 .list - list servers
-.info <server> - show server info
-.start <server> - start a server
-.stop <server> - stop a server
+.info <server|@group> - show server info
+.start <server|@group> - start a server, or a group in order
+.stop <server|@group> - stop a server, or a group in reverse order
+.reload - reload the servers file
+.cost [server] [YYYY-MM] - show running hours and cost for a month
+.hold <server> <duration> - keep a server up for a while, even if idle (0 to release)
+.snooze <server> - start a server's idle shutdown countdown over
+.backups <server> - list a server's backups
+.restore <server> <backup> - restore a stopped server from a backup
 `
 	case ".ping":
 		s.ChannelMessageSend(m.ChannelID, "pong")
@@ -201,87 +293,209 @@ host: %s
 uptime: %s
 `, host, uptime)
 	case ".list":
-		var servers []string
-		for _, server := range c.serverConfig.Servers {
-			status := "offline"
-			if server.online {
-				status = "online"
-			}
-			servers = append(servers, fmt.Sprintf("%-10s%s:%s", "["+status+"]", server.host, server.port))
-		}
-		msg = strings.Join(servers, "\n")
+		reply = formatList(c.servers())
 	case ".info":
 		c.discord.ChannelTyping(m.ChannelID)
+		if group, ok := strings.CutPrefix(args, "@"); ok {
+			var err error
+			if reply, err = c.infoGroup(group); err != nil {
+				msg = fmt.Sprintf("error checking group:\n%s", err)
+			}
+			break
+		}
 		val := args
 		if val == "" {
 			msg = "usage: .info <server>"
 			break
 		}
-		s, err := c.findServerFuzzy(val)
+		s, err := c.findServer(val)
 		if err != nil {
 			msg = fmt.Sprintf("error finding server:\n%s", err)
 			break
 		}
-		if err := c.setServerDefaults(s); err != nil {
+		if err := c.config().setServerDefaults(s); err != nil {
 			msg = fmt.Sprintf("error setting defaults:\n%s", err)
 			break
 		}
-		_ = c.sendMessagef("%s", s.Name)
 		pong, err := c.checkServer(s)
 		if err != nil {
 			msg = fmt.Sprintf("error checking %s:\n%s", s.Name, err)
 			break
 		}
-		msg = pong.Pretty()
+		reply = formatInfo(s, pong)
 	case ".start":
 		c.discord.ChannelTyping(m.ChannelID)
+		if group, ok := strings.CutPrefix(args, "@"); ok {
+			var err error
+			if msg, err = c.startGroup(m, group); err != nil {
+				msg = fmt.Sprintf("error starting group:\n%s", err)
+			}
+			break
+		}
 		val := args
 		if val == "" {
 			msg = "usage: .start <server>"
 			break
 		}
-		s, err := c.findServerFuzzy(val)
+		s, err := c.findServer(val)
 		if err != nil {
 			msg = fmt.Sprintf("error finding server:\n%s", err)
 			break
 		}
-		if err := c.setServerDefaults(s); err != nil {
+		if err := c.config().setServerDefaults(s); err != nil {
 			msg = fmt.Sprintf("error setting defaults:\n%s", err)
 			break
 		}
+		if c.overBudget(s) && !c.canOverrideBudget(m) {
+			msg = fmt.Sprintf("%s is over its monthly budget of $%.2f, ask someone with the override role to start it", s.Name, s.MonthlyBudget)
+			break
+		}
 		_ = c.sendMessagef("received start request for %s", s.Name)
 		msg, err = c.startServer(s)
+		c.stateChanged()
 		if err != nil {
 			msg = fmt.Sprintf("error starting %s:\n%s", s.Name, err)
 			break
 		}
+		if s.runtime().lastPong == nil {
+			c.notifyWhenJoinable(s, m.Author.Mention())
+		}
 	case ".stop":
 		c.discord.ChannelTyping(m.ChannelID)
+		if group, ok := strings.CutPrefix(args, "@"); ok {
+			confirmer, err := c.confirm(m.ChannelID, fmt.Sprintf("stop every server in @%s?", group))
+			if err != nil {
+				msg = fmt.Sprintf("not stopping @%s: %s", group, err)
+				break
+			}
+			c.Kong.Printf("%s is stopping @%s, confirmed by %s", m.Author.Username, group, confirmer.Username)
+			if msg, err = c.stopGroup(group); err != nil {
+				msg = fmt.Sprintf("error stopping group:\n%s", err)
+			}
+			break
+		}
 		val := args
 		if val == "" {
 			msg = "usage: .stop <server>"
 			break
 		}
-		s, err := c.findServerFuzzy(val)
+		s, err := c.findServer(val)
 		if err != nil {
 			msg = fmt.Sprintf("error finding server:\n%s", err)
 			break
 		}
-		if err := c.setServerDefaults(s); err != nil {
+		if err := c.config().setServerDefaults(s); err != nil {
 			msg = fmt.Sprintf("error setting defaults:\n%s", err)
 			break
 		}
+		confirmer, err := c.confirm(m.ChannelID, fmt.Sprintf("stop %s?", s.Name))
+		if err != nil {
+			msg = fmt.Sprintf("not stopping %s: %s", s.Name, err)
+			break
+		}
+		c.Kong.Printf("%s is stopping %s, confirmed by %s", m.Author.Username, s.Host, confirmer.Username)
 		_ = c.sendMessagef("received deallocation request for %s", s.Name)
-		msg, err = c.deallocateServer(s)
+		msg, err = c.deallocateServer(s, false)
+		c.stateChanged()
 		if err != nil {
 			msg = fmt.Sprintf("error deallocating %s:\n%s", s.Name, err)
 			break
 		}
+	case ".reload":
+		var err error
+		msg, err = c.reload()
+		if err != nil {
+			msg = fmt.Sprintf("error reloading servers, keeping the old ones:\n%s", err)
+		}
+	case ".cost":
+		var err error
+		msg, err = c.costReport(args)
+		if err != nil {
+			msg = fmt.Sprintf("error getting cost:\n%s", err)
+		}
+	case ".snooze":
+		if args == "" {
+			msg = "usage: .snooze <server>"
+			break
+		}
+		s, err := c.findServer(args)
+		if err != nil {
+			msg = fmt.Sprintf("error finding server:\n%s", err)
+			break
+		}
+		c.snooze(s, m.Author.Mention())
+		return
+	case ".hold":
+		fields := strings.Fields(args)
+		if len(fields) != 2 {
+			msg = "usage: .hold <server> <duration>"
+			break
+		}
+		s, err := c.findServer(fields[0])
+		if err != nil {
+			msg = fmt.Sprintf("error finding server:\n%s", err)
+			break
+		}
+		d, err := time.ParseDuration(fields[1])
+		if err != nil {
+			msg = fmt.Sprintf("error parsing duration:\n%s", err)
+			break
+		}
+		s.hold(d)
+		c.stateChanged()
+		if !s.held() {
+			msg = fmt.Sprintf("released hold on %s", s.Name)
+			break
+		}
+		msg = fmt.Sprintf("%s will be kept up until %s", s.Name, s.heldUntil().Format(time.RFC1123))
+	case ".backups":
+		if args == "" {
+			msg = "usage: .backups <server>"
+			break
+		}
+		s, err := c.findServer(args)
+		if err != nil {
+			msg = fmt.Sprintf("error finding server:\n%s", err)
+			break
+		}
+		c.discord.ChannelTyping(m.ChannelID)
+		msg, err = c.backupsReport(s)
+		if err != nil {
+			msg = fmt.Sprintf("error listing backups of %s:\n%s", s.Name, err)
+		}
+	case ".restore":
+		fields := strings.Fields(args)
+		if len(fields) != 2 {
+			msg = "usage: .restore <server> <backup>"
+			break
+		}
+		s, err := c.findServer(fields[0])
+		if err != nil {
+			msg = fmt.Sprintf("error finding server:\n%s", err)
+			break
+		}
+		// restoring throws away whatever's happened since the backup
+		question := fmt.Sprintf("restore %s from %s? anything since then will be lost", s.Name, fields[1])
+		confirmer, err := c.confirm(m.ChannelID, question)
+		if err != nil {
+			msg = fmt.Sprintf("not restoring %s: %s", s.Name, err)
+			break
+		}
+		c.Kong.Printf("%s is restoring %s from %s, confirmed by %s", m.Author.Username, s.Host, fields[1], confirmer.Username)
+		c.discord.ChannelTyping(m.ChannelID)
+		_ = c.sendMessagef("received restore request for %s from %s", s.Name, fields[1])
+		msg, err = c.restoreServer(s, fields[1])
+		if err != nil {
+			msg = fmt.Sprintf("error restoring %s:\n%s", s.Name, err)
+		}
 	default:
 		msg = "unknown command, try .help"
 	}
 
-	if err := c.sendMessagef(msg); err != nil {
+	if reply == nil {
+		reply = &formatted{text: msg}
+	}
+	if err := c.sendFormatted(reply); err != nil {
 		c.Kong.Errorf("sending message: %v", err)
 	}
 }
@@ -0,0 +1,172 @@
+package command
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+const (
+	colorOnline  = 0x2ecc71
+	colorPending = 0xf1c40f
+	colorOffline = 0xe74c3c
+)
+
+// Discord rejects embeds over these limits, so anything bigger gets sent as
+// plain text instead
+const (
+	embedMaxLength      = 6000
+	embedMaxFields      = 25
+	embedMaxTitle       = 256
+	embedMaxDescription = 4096
+	embedMaxFieldName   = 256
+	embedMaxFieldValue  = 1024
+	embedMaxFooter      = 2048
+)
+
+// formatted is a response rendered both as an embed and as plain text, the
+// latter being the fallback for when the embed won't fit
+type formatted struct {
+	embed *discordgo.MessageEmbed
+	text  string
+}
+
+func formatInfo(s *server, pong *Pong) *formatted {
+	color := colorOnline
+	if pong.PlayerCount == 0 {
+		color = colorPending
+	}
+	embed := &discordgo.MessageEmbed{
+		Title:       s.Name,
+		Description: pong.ServerName,
+		Color:       color,
+		Fields: []*discordgo.MessageEmbedField{
+			{Name: "Version", Value: fmt.Sprintf("%s (%s)", pong.VersionName, pong.Edition), Inline: true},
+			{Name: "Players", Value: fmt.Sprintf("%d/%d", pong.PlayerCount, pong.MaxPlayerCount), Inline: true},
+			{Name: "Game mode", Value: pong.GameMode, Inline: true},
+			{Name: "World", Value: pong.WorldName, Inline: true},
+			{Name: "Port", Value: fmt.Sprintf("%d (IPv4), %d (IPv6)", pong.PortIPv4, pong.PortIPv6), Inline: true},
+		},
+	}
+	setCheckFooter(embed, s, pong)
+	return &formatted{embed: embed, text: pong.Pretty()}
+}
+
+func formatList(servers []*server) *formatted {
+	embed := &discordgo.MessageEmbed{
+		Title: "Servers",
+		Color: colorOffline,
+	}
+	var lines []string
+	var lastChecked time.Time
+	for _, s := range servers {
+		rt := s.runtime()
+		status := "offline"
+		if rt.online {
+			status = "online"
+			embed.Color = colorOnline
+		}
+		lines = append(lines, fmt.Sprintf("%-10s%s", "["+status+"]", net.JoinHostPort(s.host, s.port)))
+
+		value := fmt.Sprintf("`%s`", net.JoinHostPort(s.host, s.port))
+		if rt.online && rt.lastPong != nil {
+			value += fmt.Sprintf("\n%d/%d players, %s", rt.lastPong.PlayerCount, rt.lastPong.MaxPlayerCount, rt.lastPong.VersionName)
+		}
+		embed.Fields = append(embed.Fields, &discordgo.MessageEmbedField{
+			Name:  fmt.Sprintf("%s %s", statusIcon(s), s.Name),
+			Value: value,
+		})
+		if rt.lastChecked.After(lastChecked) {
+			lastChecked = rt.lastChecked
+		}
+	}
+	if !lastChecked.IsZero() {
+		embed.Footer = &discordgo.MessageEmbedFooter{Text: "last checked"}
+		embed.Timestamp = lastChecked.Format(time.RFC3339)
+	}
+	return &formatted{embed: embed, text: strings.Join(lines, "\n")}
+}
+
+// formatNotice renders an announcement about a server, e.g. that it's being
+// deallocated
+func formatNotice(s *server, msg string) *formatted {
+	embed := &discordgo.MessageEmbed{
+		Title:       s.Name,
+		Description: msg,
+		Color:       statusColor(s),
+	}
+	setCheckFooter(embed, s, s.runtime().lastPong)
+	return &formatted{embed: embed, text: msg}
+}
+
+func setCheckFooter(embed *discordgo.MessageEmbed, s *server, pong *Pong) {
+	lastChecked := s.runtime().lastChecked
+	if lastChecked.IsZero() {
+		return
+	}
+	footer := "last checked"
+	if pong != nil {
+		footer = fmt.Sprintf("latency %s · last checked", pong.Latency.Round(time.Millisecond))
+	}
+	embed.Footer = &discordgo.MessageEmbedFooter{Text: footer}
+	embed.Timestamp = lastChecked.Format(time.RFC3339)
+}
+
+func statusColor(s *server) int {
+	rt := s.runtime()
+	switch {
+	case !rt.online:
+		return colorOffline
+	case rt.lastPong == nil:
+		return colorPending
+	default:
+		return colorOnline
+	}
+}
+
+func statusIcon(s *server) string {
+	rt := s.runtime()
+	switch {
+	case !rt.online:
+		return "🔴"
+	case rt.lastPong == nil:
+		return "🟡"
+	default:
+		return "🟢"
+	}
+}
+
+func (f *formatted) fits() bool {
+	e := f.embed
+	if len(e.Fields) > embedMaxFields || len(e.Title) > embedMaxTitle || len(e.Description) > embedMaxDescription {
+		return false
+	}
+	n := len(e.Title) + len(e.Description)
+	if e.Footer != nil {
+		if len(e.Footer.Text) > embedMaxFooter {
+			return false
+		}
+		n += len(e.Footer.Text)
+	}
+	for _, field := range e.Fields {
+		// fields can't be empty either
+		if field.Name == "" || field.Value == "" || len(field.Name) > embedMaxFieldName || len(field.Value) > embedMaxFieldValue {
+			return false
+		}
+		n += len(field.Name) + len(field.Value)
+	}
+	return n <= embedMaxLength
+}
+
+// sendFormatted sends the embed to the management channel, or the plain text
+// version if the embed is too large
+func (c *Discord) sendFormatted(f *formatted) error {
+	if f.embed == nil || !f.fits() {
+		return c.sendMessagef("%s", f.text)
+	}
+	_, err := c.discord.ChannelMessageSendEmbed(c.ManagementChannel, f.embed)
+	return err
+}
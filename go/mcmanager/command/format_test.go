@@ -0,0 +1,48 @@
+package command
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+func TestFits(t *testing.T) {
+	field := func(name, value string) *discordgo.MessageEmbedField {
+		return &discordgo.MessageEmbedField{Name: name, Value: value}
+	}
+	fields := func(n int) []*discordgo.MessageEmbedField {
+		fields := []*discordgo.MessageEmbedField{}
+		for i := 0; i < n; i++ {
+			fields = append(fields, field("name", "value"))
+		}
+		return fields
+	}
+
+	tests := []struct {
+		name  string
+		embed *discordgo.MessageEmbed
+		want  bool
+	}{
+		{"small", &discordgo.MessageEmbed{Title: "t", Description: "d", Fields: fields(3)}, true},
+		{"max fields", &discordgo.MessageEmbed{Fields: fields(25)}, true},
+		{"too many fields", &discordgo.MessageEmbed{Fields: fields(26)}, false},
+		{"long title", &discordgo.MessageEmbed{Title: strings.Repeat("a", 257)}, false},
+		{"long description", &discordgo.MessageEmbed{Description: strings.Repeat("a", 4097)}, false},
+		{"long footer", &discordgo.MessageEmbed{Footer: &discordgo.MessageEmbedFooter{Text: strings.Repeat("a", 2049)}}, false},
+		{"long field name", &discordgo.MessageEmbed{Fields: []*discordgo.MessageEmbedField{field(strings.Repeat("a", 257), "v")}}, false},
+		{"max field value", &discordgo.MessageEmbed{Fields: []*discordgo.MessageEmbedField{field("n", strings.Repeat("a", 1024))}}, true},
+		{"long field value", &discordgo.MessageEmbed{Fields: []*discordgo.MessageEmbedField{field("n", strings.Repeat("a", 1025))}}, false},
+		{"empty field value", &discordgo.MessageEmbed{Fields: []*discordgo.MessageEmbedField{field("n", "")}}, false},
+		{"too long in total", &discordgo.MessageEmbed{Description: strings.Repeat("a", 4000), Fields: []*discordgo.MessageEmbedField{
+			field("n", strings.Repeat("a", 1000)), field("n", strings.Repeat("a", 1000)),
+		}}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := (&formatted{embed: tt.embed}).fits(); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,149 @@
+package command
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// a group is a set of servers that are started and stopped together. it's
+// split into stages, e.g. backends and then a hub that connects to them.
+// servers in a stage are handled concurrently, and a stage only starts once
+// the previous one has. stopping goes through the stages in reverse.
+type group [][]string
+
+const defaultMaxParallel = 4
+
+// findGroup resolves the servers in each of the group's stages
+func (c *Discord) findGroup(name string) ([][]*server, error) {
+	return resolveGroup(c.config(), name)
+}
+
+func resolveGroup(cfg *serverConfig, name string) ([][]*server, error) {
+	g, ok := cfg.Groups[name]
+	if !ok {
+		return nil, fmt.Errorf("group %q not found", name)
+	}
+	stages := [][]*server{}
+	for _, names := range g {
+		stage := []*server{}
+		for _, n := range names {
+			s, err := resolveServer(cfg.Servers, n)
+			if err != nil {
+				return nil, fmt.Errorf("group %s: %w", name, err)
+			}
+			stage = append(stage, s)
+		}
+		stages = append(stages, stage)
+	}
+	return stages, nil
+}
+
+// fanOut runs op over every server in the stages, a stage at a time, with at
+// most max_parallel ops running at once. if an op in a stage fails, the
+// later stages are skipped. the results are in the order of the stages.
+func (c *Discord) fanOut(stages [][]*server, op func(*server) (string, error)) []string {
+	limit := c.config().MaxParallel
+	sem := make(chan struct{}, limit)
+
+	results := []string{}
+	for i, stage := range stages {
+		lines := make([]string, len(stage))
+		failed := false
+		wg := sync.WaitGroup{}
+		mu := sync.Mutex{}
+		for j, s := range stage {
+			wg.Add(1)
+			go func(j int, s *server) {
+				defer wg.Done()
+				sem <- struct{}{}
+				defer func() { <-sem }()
+
+				msg, err := op(s)
+				if err != nil {
+					msg = fmt.Sprintf("error: %s", err)
+					mu.Lock()
+					failed = true
+					mu.Unlock()
+				}
+				lines[j] = fmt.Sprintf("%s: %s", s.Name, msg)
+			}(j, s)
+		}
+		wg.Wait()
+		results = append(results, lines...)
+
+		if failed && i < len(stages)-1 {
+			for _, rest := range stages[i+1:] {
+				for _, s := range rest {
+					results = append(results, fmt.Sprintf("%s: skipped since an earlier server failed", s.Name))
+				}
+			}
+			break
+		}
+	}
+	return results
+}
+
+func (c *Discord) startGroup(m *discordgo.MessageCreate, name string) (string, error) {
+	stages, err := c.findGroup(name)
+	if err != nil {
+		return "", err
+	}
+	_ = c.sendMessagef("received start request for @%s", name)
+	results := c.fanOut(stages, func(s *server) (string, error) {
+		if c.overBudget(s) && !c.canOverrideBudget(m) {
+			return "", fmt.Errorf("over its monthly budget of $%.2f", s.MonthlyBudget)
+		}
+		msg, err := c.startServer(s)
+		if err != nil || s.runtime().lastPong != nil {
+			return msg, err
+		}
+		// the next stage may depend on this one, so wait until it's
+		// actually joinable
+		pong, err := c.waitUntilJoinable(c.ctx, s)
+		if err != nil {
+			return "", err
+		}
+		return joinableMessage(s, pong), nil
+	})
+	c.stateChanged()
+	return strings.Join(results, "\n"), nil
+}
+
+func (c *Discord) stopGroup(name string) (string, error) {
+	stages, err := c.findGroup(name)
+	if err != nil {
+		return "", err
+	}
+	reversed := make([][]*server, len(stages))
+	for i, stage := range stages {
+		reversed[len(stages)-1-i] = stage
+	}
+	_ = c.sendMessagef("received deallocation request for @%s", name)
+	results := c.fanOut(reversed, func(s *server) (string, error) {
+		return c.deallocateServer(s, false)
+	})
+	c.stateChanged()
+	return strings.Join(results, "\n"), nil
+}
+
+// infoGroup checks every server in the group and lists them
+func (c *Discord) infoGroup(name string) (*formatted, error) {
+	stages, err := c.findGroup(name)
+	if err != nil {
+		return nil, err
+	}
+	servers := []*server{}
+	for _, stage := range stages {
+		servers = append(servers, stage...)
+	}
+	c.fanOut([][]*server{servers}, func(s *server) (string, error) {
+		_, err := c.checkServer(s)
+		return "", err
+	})
+	reply := formatList(servers)
+	reply.embed.Title = "@" + name
+	return reply, nil
+}
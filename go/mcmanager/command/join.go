@@ -0,0 +1,70 @@
+package command
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// how long to wait between pings while a server boots, doubling up to the max
+const (
+	joinBackoffMin = 5 * time.Second
+	joinBackoffMax = 30 * time.Second
+)
+
+// waitUntilJoinable pings the server with backoff until Minecraft answers or
+// the server's join timeout passes. the VM being up doesn't mean Minecraft
+// is, it usually takes another minute or two.
+func (c *Discord) waitUntilJoinable(ctx context.Context, s *server) (*Pong, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.JoinTimeout)
+	defer cancel()
+
+	backoff := joinBackoffMin
+	for {
+		pong, err := c.checkServer(s)
+		if err == nil {
+			return pong, nil
+		}
+		c.Kong.Printf("%s isn't joinable yet, retrying in %s: %s", s.Host, backoff, err)
+
+		select {
+		case <-ctx.Done():
+			if ctx.Err() == context.DeadlineExceeded {
+				return nil, fmt.Errorf("%s still isn't answering after %s", s.Host, s.JoinTimeout)
+			}
+			return nil, ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > joinBackoffMax {
+			backoff = joinBackoffMax
+		}
+	}
+}
+
+// notifyWhenJoinable waits for the server to be joinable in the background,
+// then lets whoever asked for it know
+func (c *Discord) notifyWhenJoinable(s *server, mention string) {
+	c.inBackground(func() {
+		pong, err := c.waitUntilJoinable(c.ctx, s)
+		if errors.Is(err, context.Canceled) {
+			return
+		}
+		c.stateChanged()
+
+		var msg string
+		if err != nil {
+			msg = fmt.Sprintf("%s ⚠️ %s, something might be wrong", mention, err)
+		} else {
+			msg = fmt.Sprintf("%s %s", mention, joinableMessage(s, pong))
+		}
+		if _, err := c.discord.ChannelMessageSend(c.ManagementChannel, msg); err != nil {
+			c.Kong.Printf("error sending message: %s", err)
+		}
+	})
+}
+
+func joinableMessage(s *server, pong *Pong) string {
+	return fmt.Sprintf("%s is ready to join (%s, %d/%d players)", s.Name, pong.VersionName, pong.PlayerCount, pong.MaxPlayerCount)
+}
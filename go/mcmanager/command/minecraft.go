@@ -3,6 +3,7 @@ package command
 import (
 	"encoding/json"
 	"fmt"
+	"net"
 	"regexp"
 	"strings"
 	"time"
@@ -40,6 +41,8 @@ type Pong struct {
 	PortIPv4        uint16 `json:"portIPv4,string"`
 	PortIPv6        uint16 `json:"portIPv6,string"`
 	Remaining       string `json:"remaining"`
+
+	Latency time.Duration `json:"-"` // how long the ping took to come back
 }
 
 func (p *Pong) Pretty() string {
@@ -65,8 +68,10 @@ func (c *Ping) Run() error {
 }
 
 func (c *Ping) Check(host, port string, timeout time.Duration) (*Pong, error) {
-	addr := fmt.Sprintf("%s:%s", host, port)
+	addr := net.JoinHostPort(host, port)
+	start := time.Now()
 	data, err := raknet.PingTimeout(addr, timeout)
+	latency := time.Since(start)
 	if err != nil {
 		return nil, err
 	}
@@ -90,7 +95,7 @@ func (c *Ping) Check(host, port string, timeout time.Duration) (*Pong, error) {
 		return nil, err
 	}
 
-	pong := &Pong{}
+	pong := &Pong{Latency: latency}
 	if err := json.Unmarshal(jsonData, pong); err != nil {
 		return nil, err
 	}
@@ -0,0 +1,172 @@
+package command
+
+import (
+	"fmt"
+	"time"
+)
+
+// idlePolicy decides when a running server is idle enough to deallocate.
+// thresholds are numbers of consecutive checks, and default to the server's
+// deallocation_threshold.
+type idlePolicy struct {
+	MinUptime            time.Duration   `yaml:"min_uptime"`             // don't count idle checks until the server's been up this long
+	IdleThreshold        int             `yaml:"idle_threshold"`         // idle checks after players have left
+	NeverJoinedThreshold int             `yaml:"never_joined_threshold"` // idle checks if nobody's joined since it started
+	ErrorThreshold       int             `yaml:"error_threshold"`        // checks where Minecraft didn't answer
+	Timezone             string          `yaml:"timezone"`               // for the rules' times of day
+	Rules                []*idleWindow   `yaml:"rules"`
+	WarnBefore           []time.Duration `yaml:"warn_before"` // when to warn about an upcoming idle shutdown, e.g. [10m, 3m]
+	DryRun               bool            `yaml:"dry_run"`     // only announce what would be deallocated
+
+	loc *time.Location
+}
+
+// idleWindow overrides the policy's thresholds during a time of day, e.g. to
+// shut down sooner overnight. a window can wrap past midnight.
+type idleWindow struct {
+	From                 string `yaml:"from"` // e.g. 23:00
+	To                   string `yaml:"to"`   // e.g. 07:00
+	IdleThreshold        int    `yaml:"idle_threshold"`
+	NeverJoinedThreshold int    `yaml:"never_joined_threshold"`
+	ErrorThreshold       int    `yaml:"error_threshold"`
+
+	from, to time.Duration // since midnight
+}
+
+// an idleRule looks at a server's recent checks, returning why it should be
+// deallocated, or an empty string if it shouldn't be. it's called with s.mu
+// held.
+type idleRule func(s *server, t thresholds) string
+
+type thresholds struct {
+	idle, neverJoined, errors int
+}
+
+var idleRules = []idleRule{
+	func(s *server, t thresholds) string {
+		if s.checkErrors < t.errors {
+			return ""
+		}
+		return fmt.Sprintf("it had %d consecutive errors", s.checkErrors)
+	},
+	func(s *server, t thresholds) string {
+		if s.hadPlayers() || s.checkCount < t.neverJoined {
+			return ""
+		}
+		return fmt.Sprintf("nobody joined in the %s since it started", time.Duration(s.checkCount)*s.CheckInterval)
+	},
+	func(s *server, t thresholds) string {
+		if !s.hadPlayers() || s.checkCount < t.idle {
+			return ""
+		}
+		return fmt.Sprintf("it had no players for %s", time.Duration(s.checkCount)*s.CheckInterval)
+	},
+}
+
+// setDefaults fills in anything unset from the server's deallocation
+// threshold and parses the rules
+func (p *idlePolicy) setDefaults(threshold int) error {
+	if p.IdleThreshold == 0 {
+		p.IdleThreshold = threshold
+	}
+	if p.NeverJoinedThreshold == 0 {
+		p.NeverJoinedThreshold = p.IdleThreshold
+	}
+	if p.ErrorThreshold == 0 {
+		p.ErrorThreshold = threshold
+	}
+	var err error
+	p.loc = time.Local
+	if p.Timezone != "" {
+		if p.loc, err = time.LoadLocation(p.Timezone); err != nil {
+			return fmt.Errorf("invalid idle policy timezone: %w", err)
+		}
+	}
+	for _, w := range p.Rules {
+		if w.from, err = parseTimeOfDay(w.From); err != nil {
+			return fmt.Errorf("invalid idle rule from: %w", err)
+		}
+		if w.to, err = parseTimeOfDay(w.To); err != nil {
+			return fmt.Errorf("invalid idle rule to: %w", err)
+		}
+	}
+	return nil
+}
+
+func parseTimeOfDay(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+func (w *idleWindow) contains(t time.Time) bool {
+	since := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+	if w.from <= w.to {
+		return since >= w.from && since < w.to
+	}
+	return since >= w.from || since < w.to
+}
+
+// thresholds returns the thresholds in effect at t, the first matching rule
+// winning
+func (p *idlePolicy) thresholds(t time.Time) thresholds {
+	th := thresholds{idle: p.IdleThreshold, neverJoined: p.NeverJoinedThreshold, errors: p.ErrorThreshold}
+	t = t.In(p.loc)
+	for _, w := range p.Rules {
+		if !w.contains(t) {
+			continue
+		}
+		if w.IdleThreshold > 0 {
+			th.idle = w.IdleThreshold
+		}
+		if w.NeverJoinedThreshold > 0 {
+			th.neverJoined = w.NeverJoinedThreshold
+		}
+		if w.ErrorThreshold > 0 {
+			th.errors = w.ErrorThreshold
+		}
+		break
+	}
+	return th
+}
+
+// record updates the server's counters with the outcome of a check
+func (p *idlePolicy) record(s *server, pong *Pong, err error, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err != nil {
+		s.checkErrors++
+		return
+	}
+	s.checkErrors = 0
+	if pong.PlayerCount > 0 {
+		s.checkCount = 0
+		return
+	}
+	if now.Sub(s.startedAt) < p.MinUptime {
+		return
+	}
+	s.checkCount++
+}
+
+// evaluate returns why the server should be deallocated, or an empty string
+// if it should stay up
+func (p *idlePolicy) evaluate(s *server, now time.Time) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	th := p.thresholds(now)
+	for _, rule := range idleRules {
+		if reason := rule(s, th); reason != "" {
+			return reason
+		}
+	}
+	return ""
+}
+
+// hadPlayers is whether anyone's played since the server started. the caller
+// holds s.mu.
+func (s *server) hadPlayers() bool {
+	return !s.lastPlayerSeen.IsZero() && !s.lastPlayerSeen.Before(s.startedAt)
+}
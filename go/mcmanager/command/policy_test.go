@@ -0,0 +1,66 @@
+package command
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// run with -race, the monitors, commands and reactions all touch a server's
+// runtime state at once
+func TestServerStateConcurrently(t *testing.T) {
+	s := &server{Name: "survival", CheckInterval: time.Minute, IdlePolicy: &idlePolicy{}}
+	if err := s.IdlePolicy.setDefaults(3); err != nil {
+		t.Fatal(err)
+	}
+	pong := &Pong{}
+
+	wg := sync.WaitGroup{}
+	for _, f := range []func(){
+		func() { s.IdlePolicy.record(s, pong, nil, time.Now()) },
+		func() { s.IdlePolicy.evaluate(s, time.Now()) },
+		func() { s.hold(time.Minute) },
+		func() { s.held() },
+		func() { s.markOnline() },
+		func() { s.markOffline() },
+		func() { s.resetCounts() },
+		func() { s.clearWarning() },
+		func() { s.untilIdleShutdown() },
+		func() { s.statusLine() },
+		func() { s.state() },
+	} {
+		wg.Add(1)
+		go func(f func()) {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				f()
+			}
+		}(f)
+	}
+	wg.Wait()
+}
+
+func TestIdlePolicy(t *testing.T) {
+	s := &server{Name: "survival", CheckInterval: time.Minute, IdlePolicy: &idlePolicy{}}
+	if err := s.IdlePolicy.setDefaults(3); err != nil {
+		t.Fatal(err)
+	}
+	s.markOnline()
+	now := time.Now()
+
+	for i := 0; i < 2; i++ {
+		s.IdlePolicy.record(s, &Pong{}, nil, now)
+		if reason := s.IdlePolicy.evaluate(s, now); reason != "" {
+			t.Fatalf("deallocating after %d idle checks: %s", i+1, reason)
+		}
+	}
+	s.IdlePolicy.record(s, &Pong{}, nil, now)
+	if reason := s.IdlePolicy.evaluate(s, now); reason == "" {
+		t.Errorf("not deallocating after 3 idle checks")
+	}
+
+	s.IdlePolicy.record(s, &Pong{PlayerCount: 1}, nil, now)
+	if got := s.runtime().checkCount; got != 0 {
+		t.Errorf("got check count %d after a player joined, want 0", got)
+	}
+}
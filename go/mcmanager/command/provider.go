@@ -0,0 +1,212 @@
+package command
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/compute/armcompute"
+)
+
+// ComputeProvider manages the machines our servers run on. Statuses are
+// Azure style status codes, e.g. PowerState/running or
+// ProvisioningState/updating, since that's where the servers have always
+// lived.
+type ComputeProvider interface {
+	Statuses(ctx context.Context, s *server) ([]string, error)
+	Start(ctx context.Context, s *server) error
+	Deallocate(ctx context.Context, s *server) error
+}
+
+type azureProvider struct {
+	vms       *armcompute.VirtualMachinesClient
+	disks     *armcompute.DisksClient
+	snapshots *armcompute.SnapshotsClient
+}
+
+func (p *azureProvider) Statuses(ctx context.Context, s *server) ([]string, error) {
+	resp, err := p.vms.InstanceView(ctx, s.ResourceGroup, s.Name, nil)
+	if err != nil {
+		return nil, err
+	}
+	statuses := []string{}
+	for _, status := range resp.Statuses {
+		if status.Code != nil {
+			statuses = append(statuses, *status.Code)
+		}
+	}
+	return statuses, nil
+}
+
+func (p *azureProvider) Start(ctx context.Context, s *server) error {
+	poller, err := p.vms.BeginStart(ctx, s.ResourceGroup, s.Name, nil)
+	if err != nil {
+		return fmt.Errorf("starting server: %s", err)
+	}
+	if _, err = poller.PollUntilDone(ctx, nil); err != nil {
+		return fmt.Errorf("polling until start complete: %s", err)
+	}
+	return nil
+}
+
+func (p *azureProvider) Deallocate(ctx context.Context, s *server) error {
+	poller, err := p.vms.BeginDeallocate(ctx, s.ResourceGroup, s.Name, nil)
+	if err != nil {
+		return fmt.Errorf("deallocating server: %s", err)
+	}
+	if _, err = poller.PollUntilDone(ctx, nil); err != nil {
+		return fmt.Errorf("polling until deallocation complete: %s", err)
+	}
+	return nil
+}
+
+// snapshots are tagged with the server they're of, since they all live in the
+// server's resource group alongside whatever else is there
+const snapshotTag = "mcmanager-server"
+
+// CreateBackup snapshots the server's OS disk
+func (p *azureProvider) CreateBackup(ctx context.Context, s *server) (*backup, error) {
+	vm, err := p.vms.Get(ctx, s.ResourceGroup, s.Name, nil)
+	if err != nil {
+		return nil, err
+	}
+	if vm.Properties == nil || vm.Properties.StorageProfile == nil || vm.Properties.StorageProfile.OSDisk == nil ||
+		vm.Properties.StorageProfile.OSDisk.ManagedDisk == nil || vm.Properties.StorageProfile.OSDisk.ManagedDisk.ID == nil {
+		return nil, fmt.Errorf("%s has no managed OS disk", s.Name)
+	}
+	diskID := vm.Properties.StorageProfile.OSDisk.ManagedDisk.ID
+
+	created := time.Now().UTC()
+	name := fmt.Sprintf("%s-%s", s.Name, created.Format("20060102150405"))
+	poller, err := p.snapshots.BeginCreateOrUpdate(ctx, s.ResourceGroup, name, armcompute.Snapshot{
+		Location: vm.Location,
+		Tags:     map[string]*string{snapshotTag: to.Ptr(s.Name)},
+		Properties: &armcompute.SnapshotProperties{
+			CreationData: &armcompute.CreationData{
+				CreateOption:     to.Ptr(armcompute.DiskCreateOptionCopy),
+				SourceResourceID: diskID,
+			},
+			Incremental: to.Ptr(true),
+		},
+	}, nil)
+	if err != nil {
+		return nil, fmt.Errorf("creating snapshot: %s", err)
+	}
+	if _, err = poller.PollUntilDone(ctx, nil); err != nil {
+		return nil, fmt.Errorf("polling until snapshot complete: %s", err)
+	}
+	return &backup{ID: name, Created: created}, nil
+}
+
+func (p *azureProvider) ListBackups(ctx context.Context, s *server) ([]*backup, error) {
+	backups := []*backup{}
+	pager := p.snapshots.NewListByResourceGroupPager(s.ResourceGroup, nil)
+	for pager.More() {
+		page, err := pager.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, snapshot := range page.Value {
+			if snapshot.Name == nil || snapshot.Tags[snapshotTag] == nil || *snapshot.Tags[snapshotTag] != s.Name {
+				continue
+			}
+			b := &backup{ID: *snapshot.Name}
+			if snapshot.Properties != nil && snapshot.Properties.TimeCreated != nil {
+				b.Created = *snapshot.Properties.TimeCreated
+			}
+			backups = append(backups, b)
+		}
+	}
+	return backups, nil
+}
+
+func (p *azureProvider) DeleteBackup(ctx context.Context, s *server, id string) error {
+	poller, err := p.snapshots.BeginDelete(ctx, s.ResourceGroup, id, nil)
+	if err != nil {
+		return fmt.Errorf("deleting snapshot: %s", err)
+	}
+	if _, err = poller.PollUntilDone(ctx, nil); err != nil {
+		return fmt.Errorf("polling until snapshot deletion complete: %s", err)
+	}
+	return nil
+}
+
+// RestoreBackup creates a new disk from the snapshot and swaps it in as the
+// server's OS disk. the old disk is left around in case the restore was a
+// mistake.
+func (p *azureProvider) RestoreBackup(ctx context.Context, s *server, id string) error {
+	snapshot, err := p.snapshots.Get(ctx, s.ResourceGroup, id, nil)
+	if err != nil {
+		return err
+	}
+	if snapshot.Tags[snapshotTag] == nil || *snapshot.Tags[snapshotTag] != s.Name {
+		return fmt.Errorf("%s isn't a backup of %s", id, s.Name)
+	}
+	vm, err := p.vms.Get(ctx, s.ResourceGroup, s.Name, nil)
+	if err != nil {
+		return err
+	}
+	if vm.Properties == nil || vm.Properties.StorageProfile == nil || vm.Properties.StorageProfile.OSDisk == nil ||
+		vm.Properties.StorageProfile.OSDisk.ManagedDisk == nil || vm.Properties.StorageProfile.OSDisk.ManagedDisk.ID == nil {
+		return fmt.Errorf("%s has no managed OS disk", s.Name)
+	}
+	old, err := p.disks.Get(ctx, s.ResourceGroup, path.Base(*vm.Properties.StorageProfile.OSDisk.ManagedDisk.ID), nil)
+	if err != nil {
+		return err
+	}
+
+	name := fmt.Sprintf("%s-osdisk-%s", s.Name, strings.TrimPrefix(id, s.Name+"-"))
+	diskPoller, err := p.disks.BeginCreateOrUpdate(ctx, s.ResourceGroup, name, armcompute.Disk{
+		Location: old.Location,
+		SKU:      old.SKU,
+		Zones:    old.Zones,
+		Properties: &armcompute.DiskProperties{
+			CreationData: &armcompute.CreationData{
+				CreateOption:     to.Ptr(armcompute.DiskCreateOptionCopy),
+				SourceResourceID: snapshot.ID,
+			},
+		},
+	}, nil)
+	if err != nil {
+		return fmt.Errorf("creating disk: %s", err)
+	}
+	disk, err := diskPoller.PollUntilDone(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("polling until disk complete: %s", err)
+	}
+
+	vmPoller, err := p.vms.BeginUpdate(ctx, s.ResourceGroup, s.Name, armcompute.VirtualMachineUpdate{
+		Properties: &armcompute.VirtualMachineProperties{
+			StorageProfile: &armcompute.StorageProfile{
+				OSDisk: &armcompute.OSDisk{
+					Name:        disk.Name,
+					ManagedDisk: &armcompute.ManagedDiskParameters{ID: disk.ID},
+				},
+			},
+		},
+	}, nil)
+	if err != nil {
+		return fmt.Errorf("swapping OS disk: %s", err)
+	}
+	if _, err = vmPoller.PollUntilDone(ctx, nil); err != nil {
+		return fmt.Errorf("polling until OS disk swap complete: %s", err)
+	}
+	return nil
+}
+
+// powerState returns the server's power state, e.g. running or deallocated
+func powerState(ctx context.Context, p ComputeProvider, s *server) (string, error) {
+	statuses, err := p.Statuses(ctx, s)
+	if err != nil {
+		return "", err
+	}
+	for _, status := range statuses {
+		if state, ok := strings.CutPrefix(status, "PowerState/"); ok {
+			return state, nil
+		}
+	}
+	return "unknown", nil
+}
@@ -0,0 +1,154 @@
+package command
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// loadServerConfig reads and validates the servers file, without touching the
+// running config
+func (c *Discord) loadServerConfig() (*serverConfig, error) {
+	cfg, err := readServerConfig(c.ServersFile)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range cfg.Servers {
+		s.usage = c.usage
+	}
+	return cfg, nil
+}
+
+// reload swaps in the servers file's current config. servers that were
+// removed stop being monitored, new ones start being monitored, and changed
+// ones are restarted with their new settings but keep their state. if the
+// new config is invalid, the old one is kept.
+func (c *Discord) reload() (string, error) {
+	c.reloadMu.Lock()
+	defer c.reloadMu.Unlock()
+
+	cfg, err := c.loadServerConfig()
+	if err != nil {
+		return "", err
+	}
+
+	old := map[string]*server{}
+	for _, s := range c.servers() {
+		old[s.Name] = s
+	}
+
+	var added, removed, changed []string
+	restart := []*server{}
+	for i, s := range cfg.Servers {
+		prev, ok := old[s.Name]
+		delete(old, s.Name)
+		switch {
+		case !ok:
+			added = append(added, s.Name)
+			restart = append(restart, s)
+		case sameServerConfig(prev, s):
+			// keep the running one so nothing gets interrupted
+			cfg.Servers[i] = prev
+		default:
+			changed = append(changed, s.Name)
+			s.inheritState(prev)
+			c.stopMonitoring(prev)
+			restart = append(restart, s)
+		}
+	}
+	for name, s := range old {
+		removed = append(removed, name)
+		c.stopMonitoring(s)
+	}
+
+	c.configMu.Lock()
+	c.serverConfig = cfg
+	c.configMu.Unlock()
+
+	for _, s := range restart {
+		c.startMonitoring(s)
+	}
+	c.stateChanged()
+
+	if len(added)+len(removed)+len(changed) == 0 {
+		return "reloaded servers, nothing changed", nil
+	}
+	lines := []string{"reloaded servers"}
+	for _, diff := range []struct {
+		label string
+		names []string
+	}{
+		{"added", added},
+		{"removed", removed},
+		{"changed", changed},
+	} {
+		if len(diff.names) > 0 {
+			lines = append(lines, fmt.Sprintf("%s: %s", diff.label, strings.Join(diff.names, ", ")))
+		}
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+// sameServerConfig compares what was configured for the servers in the
+// servers file, i.e. everything but their runtime state
+func sameServerConfig(a, b *server) bool {
+	x, errX := yaml.Marshal(a)
+	y, errY := yaml.Marshal(b)
+	return errX == nil && errY == nil && string(x) == string(y)
+}
+
+// inheritState carries the runtime state of a server over from its previous
+// config
+func (s *server) inheritState(prev *server) {
+	rt := prev.runtime()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.checkCount = rt.checkCount
+	s.checkErrors = rt.checkErrors
+	s.online = rt.online
+	s.startedAt = rt.startedAt
+	s.lastPong = rt.lastPong
+	s.lastChecked = rt.lastChecked
+	s.holdUntil = rt.holdUntil
+	s.lastPlayerSeen = rt.lastPlayerSeen
+}
+
+// watchServersFile reloads the servers file whenever it changes, reporting
+// the outcome to the management channel, until we're shutting down
+func (c *Discord) watchServersFile() {
+	var lastMod time.Time
+	if info, err := os.Stat(c.ServersFile); err == nil {
+		lastMod = info.ModTime()
+	}
+
+	ticker := time.NewTicker(c.ServersFileCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		info, err := os.Stat(c.ServersFile)
+		if err != nil {
+			c.Kong.Printf("error checking servers file: %s", err)
+			continue
+		}
+		if !info.ModTime().After(lastMod) {
+			continue
+		}
+		lastMod = info.ModTime()
+
+		c.Kong.Printf("servers file changed, reloading")
+		msg, err := c.reload()
+		if err != nil {
+			msg = fmt.Sprintf("error reloading servers, keeping the old ones:\n%s", err)
+		}
+		c.Kong.Printf(msg)
+		_ = c.sendMessagef("%s", msg)
+	}
+}
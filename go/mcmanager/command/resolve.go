@@ -0,0 +1,155 @@
+package command
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// findServer resolves what a user typed into one of the configured servers
+func (c *Discord) findServer(query string) (*server, error) {
+	return resolveServer(c.servers(), query)
+}
+
+// resolveServer picks the server a query refers to, trying in order:
+//
+//  1. an exact name or host
+//  2. an exact alias
+//  3. the first label of a unique host, e.g. mc1 for mc1.example.com
+//  4. a unique prefix of a name, host or alias
+//  5. a unique substring of a name, host or alias
+//
+// if it can't settle on one server, the error suggests the closest ones.
+// matching is case insensitive.
+func resolveServer(servers []*server, query string) (*server, error) {
+	q := strings.ToLower(strings.TrimSpace(query))
+	if q == "" {
+		return nil, fmt.Errorf("no server given")
+	}
+
+	for _, s := range servers {
+		if q == strings.ToLower(s.Name) || q == strings.ToLower(s.Host) || q == strings.ToLower(s.host) {
+			return s, nil
+		}
+	}
+	for _, s := range servers {
+		for _, alias := range s.Aliases {
+			if q == strings.ToLower(alias) {
+				return s, nil
+			}
+		}
+	}
+
+	labelled := []*server{}
+	for _, s := range servers {
+		if q == strings.ToLower(strings.SplitN(s.host, ".", 2)[0]) {
+			labelled = append(labelled, s)
+		}
+	}
+	if len(labelled) == 1 {
+		return labelled[0], nil
+	}
+
+	for _, match := range []func(key string) bool{
+		func(key string) bool { return strings.HasPrefix(key, q) },
+		func(key string) bool { return strings.Contains(key, q) },
+	} {
+		candidates := []*server{}
+		for _, s := range servers {
+			for _, key := range s.keys() {
+				if match(key) {
+					candidates = append(candidates, s)
+					break
+				}
+			}
+		}
+		switch len(candidates) {
+		case 0:
+			continue
+		case 1:
+			return candidates[0], nil
+		default:
+			return nil, fmt.Errorf("multiple servers match %q, did you mean %s?", query, suggest(candidates, q))
+		}
+	}
+
+	// nothing matched at all, so maybe it's a typo
+	tolerance := len(q) / 3
+	if tolerance < 2 {
+		tolerance = 2
+	}
+	nearby := []*server{}
+	for _, s := range servers {
+		if s.distance(q) <= tolerance {
+			nearby = append(nearby, s)
+		}
+	}
+	if len(nearby) == 0 {
+		return nil, fmt.Errorf("server %q not found", query)
+	}
+	return nil, fmt.Errorf("server %q not found, did you mean %s?", query, suggest(nearby, q))
+}
+
+// keys are everything a server can be referred to by, lowercased, including
+// the first label of its host so typos of it are still close
+func (s *server) keys() []string {
+	keys := []string{strings.ToLower(s.Name), strings.ToLower(s.Host), strings.ToLower(strings.SplitN(s.host, ".", 2)[0])}
+	for _, alias := range s.Aliases {
+		keys = append(keys, strings.ToLower(alias))
+	}
+	return keys
+}
+
+// distance is the smallest edit distance between the query and any of the
+// server's keys
+func (s *server) distance(q string) int {
+	best := -1
+	for _, key := range s.keys() {
+		if d := levenshtein(q, key); best < 0 || d < best {
+			best = d
+		}
+	}
+	return best
+}
+
+// suggest lists the servers closest to the query first, e.g. "a, b or c"
+func suggest(servers []*server, q string) string {
+	sort.SliceStable(servers, func(i, j int) bool {
+		return servers[i].distance(q) < servers[j].distance(q)
+	})
+	names := []string{}
+	for _, s := range servers {
+		names = append(names, s.Host)
+	}
+	if len(names) == 1 {
+		return names[0]
+	}
+	return strings.Join(names[:len(names)-1], ", ") + " or " + names[len(names)-1]
+}
+
+func levenshtein(a, b string) int {
+	x, y := []rune(a), []rune(b)
+	prev := make([]int, len(y)+1)
+	curr := make([]int, len(y)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(x); i++ {
+		curr[0] = i
+		for j := 1; j <= len(y); j++ {
+			cost := 1
+			if x[i-1] == y[j-1] {
+				cost = 0
+			}
+			curr[j] = prev[j] + 1
+			if curr[j-1]+1 < curr[j] {
+				curr[j] = curr[j-1] + 1
+			}
+			if prev[j-1]+cost < curr[j] {
+				curr[j] = prev[j-1] + cost
+			}
+		}
+		prev, curr = curr, prev
+	}
+	return prev[len(y)]
+}
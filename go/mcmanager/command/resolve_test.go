@@ -0,0 +1,92 @@
+package command
+
+import (
+	"strings"
+	"testing"
+)
+
+func testServers(t *testing.T) []*server {
+	t.Helper()
+	servers := []*server{
+		{Name: "survival", Host: "mc1.example.com:19132", Aliases: []string{"smp"}},
+		{Name: "creative", Host: "mc10.example.com", Aliases: []string{"build"}},
+		{Name: "skyblock", Host: "sky.example.org"},
+	}
+	for _, s := range servers {
+		var err error
+		if s.host, s.port, err = splitHost(s.Host); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return servers
+}
+
+func TestResolveServer(t *testing.T) {
+	tests := []struct {
+		name  string
+		query string
+		want  string // the server's name
+		err   string // what the error should contain, in order
+	}{
+		{name: "exact name", query: "survival", want: "survival"},
+		{name: "exact name any case", query: " Creative ", want: "creative"},
+		{name: "exact host with port", query: "mc1.example.com:19132", want: "survival"},
+		{name: "exact host without port", query: "MC1.example.com", want: "survival"},
+		{name: "alias", query: "smp", want: "survival"},
+		{name: "alias any case", query: "BUILD", want: "creative"},
+		{name: "host label", query: "mc1", want: "survival"},
+		{name: "longer host label", query: "mc10", want: "creative"},
+		{name: "unique prefix", query: "cre", want: "creative"},
+		{name: "unique prefix of a host", query: "sky.ex", want: "skyblock"},
+		{name: "unique substring", query: "block", want: "skyblock"},
+		{name: "unique substring of a host", query: ".org", want: "skyblock"},
+		{name: "ambiguous prefix", query: "mc", err: "multiple servers match \"mc\", did you mean"},
+		{name: "ambiguous substring", query: "example", err: "multiple servers match \"example\", did you mean"},
+		{name: "typo of a name", query: "survivl", err: "server \"survivl\" not found, did you mean mc1.example.com:19132?"},
+		{name: "typo of an alias", query: "biuld", err: "server \"biuld\" not found, did you mean mc10.example.com?"},
+		{name: "typo of a host label", query: "mc2", err: "server \"mc2\" not found, did you mean mc1.example.com:19132 or mc10.example.com?"},
+		{name: "nothing close", query: "zzzzzzzz", err: "server \"zzzzzzzz\" not found"},
+		{name: "empty", query: "  ", err: "no server given"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := resolveServer(testServers(t), tt.query)
+			if tt.err != "" {
+				if err == nil {
+					t.Fatalf("got %s, want an error", s.Name)
+				}
+				if !strings.HasPrefix(err.Error(), tt.err) {
+					t.Errorf("got error %q, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if s.Name != tt.want {
+				t.Errorf("got %s, want %s", s.Name, tt.want)
+			}
+		})
+	}
+}
+
+func TestLevenshtein(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"", "", 0},
+		{"abc", "", 3},
+		{"", "abc", 3},
+		{"mc1", "mc1", 0},
+		{"mc2", "mc1", 1},
+		{"mc2", "mc10", 2},
+		{"kitten", "sitting", 3},
+		{"naïve", "naive", 1},
+	}
+	for _, tt := range tests {
+		if got := levenshtein(tt.a, tt.b); got != tt.want {
+			t.Errorf("levenshtein(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
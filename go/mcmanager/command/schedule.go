@@ -0,0 +1,136 @@
+package command
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/robfig/cron/v3"
+)
+
+// schedule is a server's regular play window, e.g. start on Friday evening
+// and stop early Saturday morning. either end is optional.
+type schedule struct {
+	Start    string `yaml:"start"`
+	Stop     string `yaml:"stop"`
+	Timezone string `yaml:"timezone"`
+
+	start cron.Schedule
+	stop  cron.Schedule
+	loc   *time.Location
+}
+
+type scheduledAction string
+
+const (
+	scheduledStart scheduledAction = "start"
+	scheduledStop  scheduledAction = "stop"
+)
+
+func (sch *schedule) parse() error {
+	var err error
+	sch.loc = time.Local
+	if sch.Timezone != "" {
+		if sch.loc, err = time.LoadLocation(sch.Timezone); err != nil {
+			return fmt.Errorf("invalid schedule timezone: %w", err)
+		}
+	}
+	if sch.Start != "" {
+		if sch.start, err = cron.ParseStandard(sch.Start); err != nil {
+			return fmt.Errorf("invalid schedule start %q: %w", sch.Start, err)
+		}
+	}
+	if sch.Stop != "" {
+		if sch.stop, err = cron.ParseStandard(sch.Stop); err != nil {
+			return fmt.Errorf("invalid schedule stop %q: %w", sch.Stop, err)
+		}
+	}
+	return nil
+}
+
+// next returns the soonest scheduled action after t, or a zero time if there
+// is nothing scheduled
+func (sch *schedule) next(t time.Time) (time.Time, scheduledAction) {
+	t = t.In(sch.loc)
+	var next time.Time
+	var action scheduledAction
+	if sch.start != nil {
+		next, action = sch.start.Next(t), scheduledStart
+	}
+	if sch.stop != nil {
+		if stop := sch.stop.Next(t); next.IsZero() || stop.Before(next) {
+			next, action = stop, scheduledStop
+		}
+	}
+	return next, action
+}
+
+// runSchedule starts and stops the server according to its schedule, until
+// the context is cancelled
+func (c *Discord) runSchedule(ctx context.Context, s *server) {
+	for {
+		next, action := s.Schedule.next(time.Now())
+		if next.IsZero() {
+			return
+		}
+		c.Kong.Printf("next scheduled %s of %s at %s", action, s.Host, next)
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		// the start or stop itself runs in the background, so that shutdown
+		// isn't stuck waiting on this goroutine until Azure is done
+		c.inBackground(func() { c.runScheduledAction(s, action) })
+	}
+}
+
+func (c *Discord) runScheduledAction(s *server, action scheduledAction) {
+	var msg string
+	var err error
+	switch action {
+	case scheduledStart:
+		if c.overBudget(s) {
+			msg = fmt.Sprintf("%s is over its monthly budget, skipping its scheduled start", s.Host)
+			break
+		}
+		msg, err = c.startServer(s)
+	case scheduledStop:
+		if s.held() {
+			msg = fmt.Sprintf("%s is held until %s, skipping its scheduled stop", s.Host, s.heldUntil().Format(time.Kitchen))
+			break
+		}
+		msg, err = c.deallocateServer(s, false)
+	}
+	if err != nil {
+		msg = fmt.Sprintf("error during scheduled %s of %s:\n%s", action, s.Name, err)
+	}
+	c.Kong.Printf(msg)
+	_ = c.sendFormatted(formatNotice(s, msg))
+	c.stateChanged()
+}
+
+// hold keeps the server from being deallocated for being idle for the given
+// duration. a zero duration releases any hold.
+func (s *server) hold(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if d <= 0 {
+		s.holdUntil = time.Time{}
+		return
+	}
+	s.holdUntil = time.Now().Add(d)
+}
+
+func (s *server) held() bool {
+	return time.Now().Before(s.heldUntil())
+}
+
+func (s *server) heldUntil() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.holdUntil
+}
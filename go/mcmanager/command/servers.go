@@ -1,53 +1,98 @@
 package command
 
 import (
-	"context"
+	"errors"
 	"fmt"
-	"strings"
+	"sync"
 	"time"
 )
 
 type serverConfig struct {
-	CheckTimeout          time.Duration `yaml:"check_timeout"`
-	CheckInterval         time.Duration `yaml:"check_interval"`
-	DeallocationThreshold int           `yaml:"deallocation_threshold"`
-	Servers               []*server     `yaml:"servers"`
+	CheckTimeout          time.Duration    `yaml:"check_timeout"`
+	CheckInterval         time.Duration    `yaml:"check_interval"`
+	DeallocationThreshold int              `yaml:"deallocation_threshold"`
+	JoinTimeout           time.Duration    `yaml:"join_timeout"`
+	IdlePolicy            *idlePolicy      `yaml:"idle_policy"`
+	HourlyRate            float64          `yaml:"hourly_rate"`
+	MonthlyBudget         float64          `yaml:"monthly_budget"`
+	BudgetOverrideRole    string           `yaml:"budget_override_role"` // a role ID allowed to start servers over budget
+	MaxParallel           int              `yaml:"max_parallel"`         // how many servers in a group to start or stop at once
+	Backup                *backupConfig    `yaml:"backup"`
+	Servers               []*server        `yaml:"servers"`
+	Groups                map[string]group `yaml:"groups"`
 }
 
 type server struct {
 	Host                  string        `yaml:"host"`
 	Name                  string        `yaml:"name"`
+	Aliases               []string      `yaml:"aliases"`
 	ResourceGroup         string        `yaml:"resource_group"`
 	CheckTimeout          time.Duration `yaml:"check_timeout"`
 	CheckInterval         time.Duration `yaml:"check_interval"`
 	DeallocationThreshold int           `yaml:"deallocation_threshold"`
+	JoinTimeout           time.Duration `yaml:"join_timeout"`
+	IdlePolicy            *idlePolicy   `yaml:"idle_policy"`
+	HourlyRate            float64       `yaml:"hourly_rate"`
+	MonthlyBudget         float64       `yaml:"monthly_budget"`
+	Schedule              *schedule     `yaml:"schedule"`
+	Backup                *backupConfig `yaml:"backup"`
+
+	host  string
+	port  string
+	usage *usageLedger
 
-	host        string
-	port        string
-	checkCount  int
-	checkErrors int
-	online      bool
+	// the monitors, commands, reactions and background work all look at a
+	// server at once, so its runtime state is only touched under mu
+	mu            sync.Mutex
+	serverRuntime `yaml:"-"`
 }
 
-func (c *Discord) findServerFuzzy(host string) (*server, error) {
-	servers := []*server{}
-	for _, server := range c.serverConfig.Servers {
-		if strings.Contains(server.Host, host) {
-			servers = append(servers, server)
-		}
-	}
-	switch len(servers) {
-	case 0:
-		return nil, fmt.Errorf("server not found")
-	case 1:
-		return servers[0], nil
-	default:
-		return nil, fmt.Errorf("multiple servers found for %q, please be more specific", host)
-	}
+type serverRuntime struct {
+	checkCount       int
+	checkErrors      int
+	online           bool
+	startedAt        time.Time // when we first saw the server come online
+	lastPong         *Pong     // the last successful check, nil if it failed
+	lastChecked      time.Time
+	holdUntil        time.Time // idle deallocation is suppressed until then
+	lastPlayerSeen   time.Time
+	lastWarning      time.Duration // the last idle warning point we warned at
+	warningMessageID string
+}
+
+// runtime returns a copy of the server's runtime state, for reading several
+// fields that should agree with each other
+func (s *server) runtime() serverRuntime {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.serverRuntime
+}
+
+func (s *server) isOnline() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.online
+}
+
+// resetCounts starts the server's idle and error counts over
+func (s *server) resetCounts() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.checkCount = 0
+	s.checkErrors = 0
 }
 
-func (c *Discord) setConfigDefaults() error {
-	cfg := c.serverConfig
+func (c *Discord) config() *serverConfig {
+	c.configMu.RLock()
+	defer c.configMu.RUnlock()
+	return c.serverConfig
+}
+
+func (c *Discord) servers() []*server {
+	return c.config().Servers
+}
+
+func (cfg *serverConfig) setDefaults() error {
 	if cfg.CheckInterval == 0 {
 		cfg.CheckInterval = 5 * time.Minute
 	}
@@ -57,25 +102,28 @@ func (c *Discord) setConfigDefaults() error {
 	if cfg.CheckTimeout == 0 {
 		cfg.CheckTimeout = 5 * time.Second
 	}
+	if cfg.JoinTimeout == 0 {
+		cfg.JoinTimeout = 5 * time.Minute
+	}
+	if cfg.MaxParallel == 0 {
+		cfg.MaxParallel = defaultMaxParallel
+	}
+	var errs []error
 	for _, s := range cfg.Servers {
-		if err := c.setServerDefaults(s); err != nil {
-			return err
+		if err := cfg.setServerDefaults(s); err != nil {
+			errs = append(errs, err)
 		}
 	}
-	return nil
+	return errors.Join(errs...)
 }
 
-func (c *Discord) setServerDefaults(s *server) error {
-	parts := strings.Split(s.Host, ":")
-	switch len(parts) {
-	case 1:
-		s.host = parts[0]
-		s.port = "19132"
-	case 2:
-		s.host = parts[0]
-		s.port = parts[1]
-	default:
-		return fmt.Errorf("invalid server host: %s", s.Host)
+// setServerDefaults fills in anything unset on the server from the config.
+// it carries on past errors so that validation can report everything else.
+func (cfg *serverConfig) setServerDefaults(s *server) error {
+	var errs []error
+	var err error
+	if s.host, s.port, err = splitHost(s.Host); err != nil {
+		errs = append(errs, err)
 	}
 	if s.Name == "" {
 		s.Name = s.host
@@ -84,40 +132,87 @@ func (c *Discord) setServerDefaults(s *server) error {
 		s.ResourceGroup = fmt.Sprintf("%s-rg", s.Name)
 	}
 	if s.CheckTimeout == 0 {
-		s.CheckTimeout = c.serverConfig.CheckTimeout
+		s.CheckTimeout = cfg.CheckTimeout
 	}
 	if s.CheckInterval == 0 {
-		s.CheckInterval = c.serverConfig.CheckInterval
+		s.CheckInterval = cfg.CheckInterval
 	}
 	if s.DeallocationThreshold == 0 {
-		s.DeallocationThreshold = c.serverConfig.DeallocationThreshold
+		s.DeallocationThreshold = cfg.DeallocationThreshold
+	}
+	if s.JoinTimeout == 0 {
+		s.JoinTimeout = cfg.JoinTimeout
+	}
+	if s.IdlePolicy == nil {
+		// copied since the thresholds default per server
+		s.IdlePolicy = &idlePolicy{}
+		if cfg.IdlePolicy != nil {
+			*s.IdlePolicy = *cfg.IdlePolicy
+		}
+	}
+	if err := s.IdlePolicy.setDefaults(s.DeallocationThreshold); err != nil {
+		errs = append(errs, fmt.Errorf("%s: %w", s.Host, err))
+	}
+	if s.HourlyRate == 0 {
+		s.HourlyRate = cfg.HourlyRate
+	}
+	if s.MonthlyBudget == 0 {
+		s.MonthlyBudget = cfg.MonthlyBudget
+	}
+	if s.Backup == nil {
+		s.Backup = &backupConfig{}
+		if cfg.Backup != nil {
+			*s.Backup = *cfg.Backup
+		}
 	}
-	return nil
+	if s.Backup.Retain == 0 {
+		s.Backup.Retain = defaultBackupRetain
+	}
+	if s.Schedule != nil {
+		if err := s.Schedule.parse(); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", s.Host, err))
+		}
+	}
+	return errors.Join(errs...)
 }
 
 func (c *Discord) checkServer(s *server) (*Pong, error) {
 	ping := &Ping{}
 	pong, err := ping.Check(s.host, s.port, s.CheckTimeout)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastPong = pong
+	s.lastChecked = time.Now()
 	if err != nil {
 		return nil, err
 	}
+	if pong.PlayerCount > 0 {
+		s.lastPlayerSeen = s.lastChecked
+	}
 	return pong, nil
 }
 
 func (c *Discord) startServer(s *server) (string, error) {
-	ping := &Ping{}
-	pong, err := ping.Check(s.host, s.port, s.CheckTimeout)
+	done, err := c.beginOp()
+	if err != nil {
+		return "", err
+	}
+	defer done()
+
+	// this also leaves lastPong nil if Minecraft isn't up, so callers know
+	// to wait for it
+	pong, err := c.checkServer(s)
 	if err == nil {
 		return fmt.Sprintf("%s is already running with %d players", s.Host, pong.PlayerCount), nil
 	}
 
 	// check if vm is already running
-	resp, err := c.vmClient.InstanceView(context.Background(), s.ResourceGroup, s.Name, nil)
+	statuses, err := c.provider.Statuses(c.opCtx, s)
 	if err != nil {
 		return "", err
 	}
-	for _, status := range resp.Statuses {
-		switch *status.Code {
+	for _, status := range statuses {
+		switch status {
 		case "ProvisioningState/updating":
 			return fmt.Sprintf("%s is currently updating, wait for it to finish whatever it's doing", s.Host), nil
 		case "PowerState/starting":
@@ -131,32 +226,35 @@ func (c *Discord) startServer(s *server) (string, error) {
 	}
 
 	s.setStatus("online")
-	poller, err := c.vmClient.BeginStart(context.Background(), s.ResourceGroup, s.Name, nil)
-	if err != nil {
-		return "", fmt.Errorf("starting server: %s", err)
-	}
-	_, err = poller.PollUntilDone(context.Background(), nil)
-	if err != nil {
-		return "", fmt.Errorf("polling until start complete: %s", err)
+	if err := c.provider.Start(c.opCtx, s); err != nil {
+		return "", err
 	}
 
 	return fmt.Sprintf("%s started", s.Host), nil
 }
 
-func (c *Discord) deallocateServer(s *server) (string, error) {
+// deallocates the server, unless people are playing on it and we're not
+// forcing it
+func (c *Discord) deallocateServer(s *server, force bool) (string, error) {
+	done, err := c.beginOp()
+	if err != nil {
+		return "", err
+	}
+	defer done()
+
 	ping := &Ping{}
 	pong, err := ping.Check(s.host, s.port, s.CheckTimeout)
-	if err == nil && pong.PlayerCount > 0 {
+	if err == nil && pong.PlayerCount > 0 && !force {
 		return fmt.Sprintf("%s has %d players; that would be rude", s.Host, pong.PlayerCount), nil
 	}
 
 	// check if vm is already stopped
-	resp, err := c.vmClient.InstanceView(context.Background(), s.ResourceGroup, s.Name, nil)
+	statuses, err := c.provider.Statuses(c.opCtx, s)
 	if err != nil {
 		return "", err
 	}
-	for _, status := range resp.Statuses {
-		switch *status.Code {
+	for _, status := range statuses {
+		switch status {
 		case "ProvisioningState/updating":
 			return fmt.Sprintf("%s is currently updating, wait for it to finish whatever it's doing", s.Host), nil
 		case "PowerState/deallocating":
@@ -170,27 +268,55 @@ func (c *Discord) deallocateServer(s *server) (string, error) {
 	}
 
 	s.setStatus("offline")
-	poller, err := c.vmClient.BeginDeallocate(context.Background(), s.ResourceGroup, s.Name, nil)
-	if err != nil {
-		return "", fmt.Errorf("deallocating server: %s", err)
+	if err := c.provider.Deallocate(c.opCtx, s); err != nil {
+		return "", err
+	}
+
+	if !s.Backup.OnStop {
+		return fmt.Sprintf("%s deallocated", s.Host), nil
+	}
+	b, err := c.backupServer(c.opCtx, s)
+	if err != nil && b == nil {
+		return fmt.Sprintf("%s deallocated, but its backup failed: %s", s.Host, err), nil
 	}
-	_, err = poller.PollUntilDone(context.Background(), nil)
 	if err != nil {
-		return "", fmt.Errorf("polling until deallocation complete: %s", err)
+		return fmt.Sprintf("%s deallocated and backed up as %s, but %s", s.Host, b.ID, err), nil
 	}
+	return fmt.Sprintf("%s deallocated and backed up as %s", s.Host, b.ID), nil
+}
 
-	return fmt.Sprintf("%s deallocated", s.Host), nil
+// markOnline flags the server as online, noting the start time if it wasn't
+// online before
+func (s *server) markOnline() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.online || s.startedAt.IsZero() {
+		s.startedAt = time.Now()
+		s.usage.started(s.Name, s.startedAt)
+	}
+	s.online = true
+}
+
+// markOffline flags the server as offline, ending its running session
+func (s *server) markOffline() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.online {
+		s.usage.stopped(s.Name, time.Now())
+	}
+	s.online = false
+	s.startedAt = time.Time{}
+	s.lastPong = nil
 }
 
 func (s *server) setStatus(status string) {
 	switch status {
 	case "online":
-		s.online = true
+		s.markOnline()
 	case "offline":
-		s.online = false
+		s.markOffline()
 	default:
 		panic(fmt.Sprintf("invalid status: %s", status))
 	}
-	s.checkCount = 0
-	s.checkErrors = 0
+	s.resetCounts()
 }
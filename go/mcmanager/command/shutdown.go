@@ -0,0 +1,71 @@
+package command
+
+import (
+	"errors"
+	"time"
+)
+
+var errShuttingDown = errors.New("shutting down, try again once I'm back")
+
+// inBackground runs f in a goroutine that shutdown waits on, unless we're
+// already shutting down
+func (c *Discord) inBackground(f func()) {
+	done, err := c.beginOp()
+	if err != nil {
+		c.Kong.Printf("not starting background work: %s", err)
+		return
+	}
+	go func() {
+		defer done()
+		f()
+	}()
+}
+
+// beginOp registers an in-flight start or stop so that shutdown waits for it.
+// the returned func must be called once the operation is done. nothing can
+// be registered once shutdown has started waiting, since adding to a wait
+// group that's being waited on isn't allowed.
+func (c *Discord) beginOp() (func(), error) {
+	c.shutdownMu.Lock()
+	defer c.shutdownMu.Unlock()
+	if c.shuttingDown || c.ctx.Err() != nil {
+		return nil, errShuttingDown
+	}
+	c.inflight.Add(1)
+	return c.inflight.Done, nil
+}
+
+// shutdown is called once the root context is cancelled. the monitors have
+// already been told to stop, so wait for them, then give any in-flight
+// starts or stops some time to finish. if they don't, stop polling them;
+// Azure carries on with the operation regardless, we just won't hear about
+// how it went.
+func (c *Discord) shutdown() {
+	c.Kong.Printf("shutting down")
+	c.monitorWG.Wait()
+
+	c.shutdownMu.Lock()
+	c.shuttingDown = true
+	c.shutdownMu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		c.inflight.Wait()
+		close(done)
+	}()
+
+	msg := "shutting down"
+	select {
+	case <-done:
+	case <-time.After(c.ShutdownTimeout):
+		c.cancelOps()
+		msg = "shutting down, some servers were still starting or stopping so check on them later"
+	}
+	c.Kong.Printf(msg)
+
+	c.saveState()
+	_ = c.sendMessagef("%s", msg)
+	if err := c.discord.Close(); err != nil {
+		c.Kong.Printf("error closing Discord session: %s", err)
+	}
+}
@@ -0,0 +1,139 @@
+package command
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"sync"
+	"time"
+)
+
+// serverState is what we remember about a server across restarts
+type serverState struct {
+	Online         bool      `json:"online"`
+	StartedAt      time.Time `json:"started_at,omitempty"`
+	CheckCount     int       `json:"check_count"`
+	CheckErrors    int       `json:"check_errors"`
+	LastPlayerSeen time.Time `json:"last_player_seen,omitempty"`
+	HoldUntil      time.Time `json:"hold_until,omitempty"`
+}
+
+// loadState restores the state of every configured server from the state
+// file, if there is one. servers that aren't in the file are left alone. a
+// corrupt file is ignored, since reconcile works out the state anyway.
+func (c *Discord) loadState() error {
+	if c.StateFile == "" {
+		return nil
+	}
+	b, err := os.ReadFile(c.StateFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	states := map[string]*serverState{}
+	if err := json.Unmarshal(b, &states); err != nil {
+		c.Kong.Printf("ignoring state file %s, it couldn't be parsed: %s", c.StateFile, err)
+		return nil
+	}
+	for _, s := range c.servers() {
+		if state, ok := states[s.Name]; ok {
+			s.restore(state)
+		}
+	}
+	return nil
+}
+
+// state is a snapshot of what to remember about the server
+func (s *server) state() *serverState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return &serverState{
+		Online:         s.online,
+		StartedAt:      s.startedAt,
+		CheckCount:     s.checkCount,
+		CheckErrors:    s.checkErrors,
+		LastPlayerSeen: s.lastPlayerSeen,
+		HoldUntil:      s.holdUntil,
+	}
+}
+
+func (s *server) restore(state *serverState) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.online = state.Online
+	s.startedAt = state.StartedAt
+	s.checkCount = state.CheckCount
+	s.checkErrors = state.CheckErrors
+	s.lastPlayerSeen = state.LastPlayerSeen
+	s.holdUntil = state.HoldUntil
+}
+
+func (c *Discord) saveState() {
+	if c.StateFile == "" {
+		return
+	}
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+
+	states := map[string]*serverState{}
+	for _, s := range c.servers() {
+		states[s.Name] = s.state()
+	}
+	b, err := json.MarshalIndent(states, "", "  ")
+	if err != nil {
+		c.Kong.Printf("error marshalling state: %s", err)
+		return
+	}
+	if err := writeFile(c.StateFile, b); err != nil {
+		c.Kong.Printf("error saving state: %s", err)
+	}
+}
+
+// writeFile writes to a temporary file first and renames it into place, so
+// that being killed mid-write doesn't leave a truncated file behind
+func writeFile(path string, b []byte) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// stateChanged persists the state and refreshes anything showing it
+func (c *Discord) stateChanged() {
+	c.saveState()
+	c.refreshStatus()
+}
+
+// reconcile checks what every server is actually doing, since the restored
+// state could be out of date, e.g. if a server was started or stopped while
+// we were down. a server counts as online if either its machine is running or
+// Minecraft answers.
+func (c *Discord) reconcile() {
+	wg := sync.WaitGroup{}
+	for _, s := range c.servers() {
+		wg.Add(1)
+		go func(s *server) {
+			defer wg.Done()
+			state, err := powerState(c.ctx, c.provider, s)
+			if err != nil {
+				c.Kong.Printf("error getting power state of %s: %s", s.Host, err)
+			}
+			_, pingErr := c.checkServer(s)
+			switch {
+			case pingErr == nil, state == "running", state == "starting":
+				s.markOnline()
+			case err == nil:
+				s.markOffline()
+			default:
+				// we couldn't reach either, so keep whatever we
+				// remembered
+			}
+			c.Kong.Printf("reconciled %s: power state %s, online %t", s.Host, state, s.isOnline())
+		}(s)
+	}
+	wg.Wait()
+	c.stateChanged()
+}
@@ -0,0 +1,170 @@
+package command
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+const statusTitle = "Minecraft servers"
+
+// refreshStatus edits the pinned status message in the status channel and
+// updates the bot's presence to reflect the latest known state of every
+// server. it's called after every check so neither can drift for long.
+func (c *Discord) refreshStatus() {
+	c.statusMu.Lock()
+	defer c.statusMu.Unlock()
+
+	online, players := 0, 0
+	for _, s := range c.servers() {
+		rt := s.runtime()
+		if !rt.online {
+			continue
+		}
+		online++
+		if rt.lastPong != nil {
+			players += int(rt.lastPong.PlayerCount)
+		}
+	}
+
+	presence := fmt.Sprintf("%d %s online, %d %s", online, plural(online, "server"), players, plural(players, "player"))
+	err := c.discord.UpdateStatusComplex(discordgo.UpdateStatusData{
+		Status: string(discordgo.StatusOnline),
+		Activities: []*discordgo.Activity{{
+			Name:  presence,
+			State: presence,
+			Type:  discordgo.ActivityTypeCustom,
+		}},
+	})
+	if err != nil {
+		c.Kong.Printf("error updating presence: %s", err)
+	}
+
+	if c.StatusChannel == "" {
+		return
+	}
+
+	embed := c.statusEmbed()
+	if c.statusMessageID != "" {
+		_, err := c.discord.ChannelMessageEditEmbed(c.StatusChannel, c.statusMessageID, embed)
+		if err == nil {
+			return
+		}
+		// the message was probably deleted, so fall through and post a
+		// new one
+		c.Kong.Printf("error editing status message: %s", err)
+		c.statusMessageID = ""
+	}
+
+	if id := c.findStatusMessage(); id != "" {
+		c.statusMessageID = id
+		if _, err := c.discord.ChannelMessageEditEmbed(c.StatusChannel, id, embed); err != nil {
+			c.Kong.Printf("error editing status message: %s", err)
+		}
+		return
+	}
+
+	m, err := c.discord.ChannelMessageSendEmbed(c.StatusChannel, embed)
+	if err != nil {
+		c.Kong.Printf("error sending status message: %s", err)
+		return
+	}
+	c.statusMessageID = m.ID
+	if err := c.discord.ChannelMessagePin(c.StatusChannel, m.ID); err != nil {
+		c.Kong.Printf("error pinning status message: %s", err)
+	}
+}
+
+// findStatusMessage looks through the status channel's pins for a status
+// message we've posted before, so a restart reuses it instead of piling up
+// new pins
+func (c *Discord) findStatusMessage() string {
+	pinned, err := c.discord.ChannelMessagesPinned(c.StatusChannel)
+	if err != nil {
+		c.Kong.Printf("error listing pinned messages: %s", err)
+		return ""
+	}
+	for _, m := range pinned {
+		if m.Author == nil || m.Author.ID != c.discord.State.User.ID {
+			continue
+		}
+		for _, e := range m.Embeds {
+			if e.Title == statusTitle {
+				return m.ID
+			}
+		}
+	}
+	return ""
+}
+
+func (c *Discord) statusEmbed() *discordgo.MessageEmbed {
+	embed := &discordgo.MessageEmbed{
+		Title:     statusTitle,
+		Color:     colorOffline,
+		Timestamp: time.Now().Format(time.RFC3339),
+		Footer:    &discordgo.MessageEmbedFooter{Text: "last updated"},
+	}
+	for _, s := range c.servers() {
+		if s.isOnline() {
+			embed.Color = colorOnline
+		}
+		embed.Fields = append(embed.Fields, &discordgo.MessageEmbedField{
+			Name:  fmt.Sprintf("%s %s", statusIcon(s), s.Name),
+			Value: s.statusLine(),
+		})
+	}
+	return embed
+}
+
+func (s *server) statusLine() string {
+	rt := s.runtime()
+	if !rt.online {
+		return "offline"
+	}
+	if rt.lastPong == nil {
+		return "running, but Minecraft isn't responding"
+	}
+
+	lines := []string{
+		fmt.Sprintf("players: %d/%d", rt.lastPong.PlayerCount, rt.lastPong.MaxPlayerCount),
+		fmt.Sprintf("version: %s", rt.lastPong.VersionName),
+	}
+	if !rt.startedAt.IsZero() {
+		lines = append(lines, fmt.Sprintf("up for: %s", time.Since(rt.startedAt).Round(time.Minute)))
+	}
+	if rt.lastPong.PlayerCount == 0 && !rt.lastPlayerSeen.IsZero() {
+		lines = append(lines, fmt.Sprintf("last player seen: <t:%d:R>", rt.lastPlayerSeen.Unix()))
+	}
+	if time.Now().Before(rt.holdUntil) {
+		lines = append(lines, fmt.Sprintf("held until: <t:%d:t>", rt.holdUntil.Unix()))
+	} else if rt.lastPong.PlayerCount == 0 {
+		lines = append(lines, fmt.Sprintf("idle shutdown in: %s", s.untilIdleShutdown()))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// untilIdleShutdown estimates how long until the server is deallocated if
+// nobody joins
+func (s *server) untilIdleShutdown() time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	th := s.IdlePolicy.thresholds(time.Now())
+	threshold := th.idle
+	if !s.hadPlayers() {
+		threshold = th.neverJoined
+	}
+	remaining := threshold - s.checkCount
+	if remaining < 0 {
+		remaining = 0
+	}
+	return time.Duration(remaining) * s.CheckInterval
+}
+
+func plural(n int, word string) string {
+	if n == 1 {
+		return word
+	}
+	return word + "s"
+}
@@ -0,0 +1,219 @@
+package command
+
+import (
+	"bytes"
+	_ "embed"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+//go:embed servers.schema.json
+var serversSchema string
+
+const defaultPort = "19132"
+
+// Azure's naming rules for VMs and resource groups
+var (
+	azureVMNameRegex        = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9._-]{0,63}$`)
+	azureResourceGroupRegex = regexp.MustCompile(`^[-\w._()]{1,90}$`)
+)
+
+type Validate struct {
+	Command
+	ServersFile string `required:"" type:"existingfile" env:"SERVERS_FILE" help:"A path to the servers file to validate"`
+}
+
+func (c *Validate) Run() error {
+	cfg, err := readServerConfig(c.ServersFile)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s is valid, %d %s\n", c.ServersFile, len(cfg.Servers), plural(len(cfg.Servers), "server"))
+	return nil
+}
+
+type Schema struct {
+	Command
+}
+
+func (c *Schema) Run() error {
+	fmt.Print(serversSchema)
+	return nil
+}
+
+// readServerConfig parses, defaults and validates a servers file
+func readServerConfig(path string) (*serverConfig, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &serverConfig{}
+	dec := yaml.NewDecoder(bytes.NewReader(raw))
+	dec.KnownFields(true)
+	if err := dec.Decode(cfg); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	// report problems with defaults together with everything else
+	if err := errors.Join(cfg.setDefaults(), cfg.validate()); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// splitHost splits a server's host into its host and port, defaulting the
+// port if there isn't one. IPv6 literals need brackets when they have a port,
+// e.g. [::1]:19132.
+func splitHost(h string) (string, string, error) {
+	if !strings.Contains(h, "]:") {
+		if ip := net.ParseIP(strings.Trim(h, "[]")); ip != nil {
+			return strings.Trim(h, "[]"), defaultPort, nil
+		}
+	}
+	if !strings.Contains(h, ":") {
+		return h, defaultPort, nil
+	}
+	host, port, err := net.SplitHostPort(h)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid server host: %s", h)
+	}
+	return host, port, nil
+}
+
+// validate checks everything we can without talking to the servers, and
+// reports every problem rather than just the first
+func (cfg *serverConfig) validate() error {
+	var errs []error
+	fail := func(format string, a ...any) {
+		errs = append(errs, fmt.Errorf(format, a...))
+	}
+
+	if len(cfg.Servers) == 0 {
+		fail("no servers configured")
+	}
+
+	names := map[string]bool{}
+	hosts := map[string]bool{}
+	keys := map[string]string{} // every name, host and alias to its server's host
+	for i, s := range cfg.Servers {
+		id := s.Host
+		if id == "" {
+			id = fmt.Sprintf("servers[%d]", i)
+			fail("%s: host is required", id)
+		}
+
+		// an unparseable host has already been reported while setting
+		// defaults, and everything derived from it is meaningless
+		_, _, hostErr := splitHost(s.Host)
+		if hostErr == nil && s.Host != "" {
+			if port, err := strconv.Atoi(s.port); err != nil || port < 1 || port > 65535 {
+				fail("%s: invalid port %q", id, s.port)
+			}
+			if s.host == "" {
+				fail("%s: missing host before the port", id)
+			}
+
+			if names[s.Name] {
+				fail("%s: duplicate name %q", id, s.Name)
+			}
+			names[s.Name] = true
+			addr := net.JoinHostPort(s.host, s.port)
+			if hosts[addr] {
+				fail("%s: duplicate host %s", id, addr)
+			}
+			hosts[addr] = true
+
+			// resolving a server by name, host or alias needs each to
+			// only refer to one server
+			for _, key := range s.keys() {
+				if other, ok := keys[key]; ok && other != s.Host {
+					fail("%s: %q also refers to %s", id, key, other)
+				}
+				keys[key] = s.Host
+			}
+		}
+
+		if s.CheckTimeout <= 0 {
+			fail("%s: check_timeout must be positive", id)
+		}
+		if s.CheckInterval <= 0 {
+			fail("%s: check_interval must be positive", id)
+		}
+		if s.CheckTimeout >= s.CheckInterval {
+			fail("%s: check_timeout (%s) must be less than check_interval (%s)", id, s.CheckTimeout, s.CheckInterval)
+		}
+		if s.JoinTimeout <= 0 {
+			fail("%s: join_timeout must be positive", id)
+		}
+		if s.DeallocationThreshold < 1 {
+			fail("%s: deallocation_threshold must be at least 1", id)
+		}
+		if p := s.IdlePolicy; p.IdleThreshold < 1 || p.NeverJoinedThreshold < 1 || p.ErrorThreshold < 1 {
+			fail("%s: idle_policy thresholds must be at least 1", id)
+		}
+		if s.IdlePolicy.MinUptime < 0 {
+			fail("%s: idle_policy min_uptime can't be negative", id)
+		}
+		for _, d := range s.IdlePolicy.WarnBefore {
+			if d <= 0 {
+				fail("%s: idle_policy warn_before durations must be positive", id)
+			}
+		}
+		for _, w := range s.IdlePolicy.Rules {
+			if w.IdleThreshold < 0 || w.NeverJoinedThreshold < 0 || w.ErrorThreshold < 0 {
+				fail("%s: idle_policy rule %s-%s thresholds can't be negative", id, w.From, w.To)
+			}
+		}
+		if s.HourlyRate < 0 {
+			fail("%s: hourly_rate can't be negative", id)
+		}
+		if s.MonthlyBudget < 0 {
+			fail("%s: monthly_budget can't be negative", id)
+		}
+		if s.MonthlyBudget > 0 && s.HourlyRate == 0 {
+			fail("%s: monthly_budget needs an hourly_rate to be enforced", id)
+		}
+		if s.Backup.Retain < 1 {
+			fail("%s: backup retain must be at least 1", id)
+		}
+
+		// the name doubles as the Azure VM name
+		if s.Name != "" && !azureVMNameRegex.MatchString(s.Name) {
+			fail("%s: name %q isn't a valid Azure VM name, set one explicitly", id, s.Name)
+		}
+		if s.Name != "" && (!azureResourceGroupRegex.MatchString(s.ResourceGroup) || strings.HasSuffix(s.ResourceGroup, ".")) {
+			fail("%s: resource_group %q isn't a valid Azure resource group name", id, s.ResourceGroup)
+		}
+	}
+
+	if cfg.MaxParallel < 1 {
+		fail("max_parallel must be at least 1")
+	}
+	for name, g := range cfg.Groups {
+		if len(g) == 0 {
+			fail("group %s: no servers", name)
+		}
+		if _, err := resolveGroup(cfg, name); err != nil {
+			fail("%s", err)
+			continue
+		}
+		seen := map[string]bool{}
+		for _, stage := range g {
+			for _, n := range stage {
+				s, _ := resolveServer(cfg.Servers, n)
+				if seen[s.Name] {
+					fail("group %s: %s is in it more than once", name, s.Name)
+				}
+				seen[s.Name] = true
+			}
+		}
+	}
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,49 @@
+package command
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReadServerConfigReportsEverything(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "servers.yml")
+	config := `
+servers:
+  - host: "mc3.example.com:1:2"
+    monthly_budget: -1
+  - host: mc1.example.com
+    schedule:
+      start: "every friday"
+  - host: mc2.example.com
+    check_timeout: 10m
+`
+	if err := os.WriteFile(path, []byte(config), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := readServerConfig(path)
+	if err == nil {
+		t.Fatal("want an error")
+	}
+	for _, want := range []string{
+		"invalid server host: mc3.example.com:1:2",
+		"mc3.example.com:1:2: monthly_budget can't be negative",
+		`mc1.example.com: invalid schedule start "every friday"`,
+		"mc2.example.com: check_timeout (10m0s) must be less than check_interval (5m0s)",
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error doesn't contain %q:\n%s", want, err)
+		}
+	}
+	if strings.Contains(err.Error(), "invalid port") {
+		t.Errorf("the bad host was reported twice:\n%s", err)
+	}
+}
+
+func TestReadServerConfigExample(t *testing.T) {
+	if _, err := readServerConfig("../servers.example.yml"); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,93 @@
+package command
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+const snoozeEmoji = "⏸️"
+
+// warnIfIdle posts a warning once the server's idle shutdown gets within one
+// of its policy's warning points, e.g. 10 minutes out and then 3 minutes out.
+// reacting to the warning snoozes the shutdown.
+func (c *Discord) warnIfIdle(s *server) {
+	if s.runtime().checkCount == 0 {
+		s.clearWarning()
+		return
+	}
+
+	remaining := s.untilIdleShutdown()
+	if remaining <= 0 {
+		return
+	}
+
+	// the tightest warning point we're within
+	var point time.Duration
+	for _, p := range s.IdlePolicy.WarnBefore {
+		if remaining <= p && (point == 0 || p < point) {
+			point = p
+		}
+	}
+	// nothing to warn about, or we've already warned at this point
+	s.mu.Lock()
+	if point == 0 || (s.lastWarning != 0 && point >= s.lastWarning) {
+		s.mu.Unlock()
+		return
+	}
+	s.lastWarning = point
+	s.mu.Unlock()
+
+	msg := fmt.Sprintf("%s will shut down in %s due to inactivity, react %s or use .snooze %s to keep it up", s.Name, remaining, snoozeEmoji, s.Name)
+	if s.IdlePolicy.DryRun {
+		msg = "dry run: " + msg
+	}
+	c.Kong.Printf(msg)
+	m, err := c.discord.ChannelMessageSend(c.ManagementChannel, msg)
+	if err != nil {
+		c.Kong.Printf("error sending warning: %s", err)
+		return
+	}
+	s.mu.Lock()
+	s.warningMessageID = m.ID
+	s.mu.Unlock()
+	if err := c.discord.MessageReactionAdd(m.ChannelID, m.ID, snoozeEmoji); err != nil {
+		c.Kong.Printf("error reacting to warning: %s", err)
+	}
+}
+
+func (c *Discord) onMessageReactionAdd(s *discordgo.Session, r *discordgo.MessageReactionAdd) {
+	if r.ChannelID != c.ManagementChannel || r.UserID == s.State.User.ID {
+		return
+	}
+	if r.Emoji.Name != snoozeEmoji {
+		return
+	}
+	for _, server := range c.servers() {
+		if id := server.runtime().warningMessageID; id != "" && id == r.MessageID {
+			c.snooze(server, "<@"+r.UserID+">")
+			return
+		}
+	}
+}
+
+// snooze starts the server's idle count over
+func (c *Discord) snooze(s *server, who string) {
+	s.mu.Lock()
+	s.checkCount = 0
+	s.mu.Unlock()
+	s.clearWarning()
+	c.stateChanged()
+	msg := fmt.Sprintf("%s snoozed the idle shutdown of %s, it'll be up for at least another %s", who, s.Name, s.untilIdleShutdown())
+	if _, err := c.discord.ChannelMessageSend(c.ManagementChannel, msg); err != nil {
+		c.Kong.Printf("error sending message: %s", err)
+	}
+}
+
+func (s *server) clearWarning() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastWarning = 0
+	s.warningMessageID = ""
+}
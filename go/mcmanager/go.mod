@@ -3,18 +3,19 @@ module github.com/andreykaipov/discord-bots/go/mcmanager
 go 1.20
 
 require (
+	github.com/Azure/azure-sdk-for-go/sdk/azcore v1.9.1
 	github.com/Azure/azure-sdk-for-go/sdk/azidentity v1.4.0
 	github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/compute/armcompute v1.0.0
 	github.com/alecthomas/kong v0.8.1
 	github.com/bradleyfalzon/ghinstallation/v2 v2.8.0
 	github.com/bwmarrin/discordgo v0.27.1
 	github.com/google/go-github/v57 v57.0.0
+	github.com/robfig/cron/v3 v3.0.1
 	github.com/sandertv/go-raknet v1.12.1
 	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
-	github.com/Azure/azure-sdk-for-go/sdk/azcore v1.9.1 // indirect
 	github.com/Azure/azure-sdk-for-go/sdk/internal v1.5.1 // indirect
 	github.com/AzureAD/microsoft-authentication-library-for-go v1.1.1 // indirect
 	github.com/df-mc/atomic v1.10.0 // indirect
@@ -7,7 +7,9 @@ import (
 
 type cli struct {
 	command.Context
-	Discord command.Discord `cmd:"" help:"Start the Discord bot."`
+	Discord  command.Discord  `cmd:"" help:"Start the Discord bot."`
+	Validate command.Validate `cmd:"" help:"Validate a servers file."`
+	Schema   command.Schema   `cmd:"" help:"Print the JSON Schema for the servers file."`
 }
 
 func main() {